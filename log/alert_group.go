@@ -0,0 +1,109 @@
+package log
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMaxGroups     = 10
+	defaultGroupExamples = 1
+)
+
+// AlertGroup summarises the records of an alert sharing one fingerprint.
+type AlertGroup struct {
+	Fingerprint string
+	Message     string
+	Labels      []slog.Attr // GroupBy 中的属性
+	Count       int
+	FirstSeen   time.Time
+	LastSeen    time.Time
+	Examples    []*slog.Record // 最近的几条日志
+}
+
+// fingerprint identifies records by their message and the values of keys.
+func fingerprint(r *slog.Record, keys []string) (string, []slog.Attr) {
+	var labels []slog.Attr
+	h := fnv.New64a()
+	h.Write([]byte(r.Message))
+	for _, key := range keys {
+		r.Attrs(func(attr slog.Attr) bool {
+			if attr.Key != key {
+				return true
+			}
+			labels = append(labels, attr)
+			fmt.Fprintf(h, "\x00%s=%s", key, attr.Value)
+			return false
+		})
+	}
+	return fmt.Sprintf("%016x", h.Sum64()), labels
+}
+
+// groupRecords groups records, which are sorted by time, by their fingerprint.
+// The groups are ordered by count and then by the time they were last seen.
+func groupRecords(records []*slog.Record, keys []string, examples int) []*AlertGroup {
+	index := make(map[string]*AlertGroup)
+	var groups []*AlertGroup
+	for _, r := range records {
+		fp, labels := fingerprint(r, keys)
+		g, ok := index[fp]
+		if !ok {
+			g = &AlertGroup{
+				Fingerprint: fp,
+				Message:     r.Message,
+				Labels:      labels,
+				FirstSeen:   r.Time,
+			}
+			index[fp] = g
+			groups = append(groups, g)
+		}
+		g.Count++
+		g.LastSeen = r.Time
+		g.Examples = append(g.Examples, r)
+		if len(g.Examples) > examples {
+			g.Examples = g.Examples[1:]
+		}
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		if groups[i].Count != groups[j].Count {
+			return groups[i].Count > groups[j].Count
+		}
+		return groups[i].LastSeen.After(groups[j].LastSeen)
+	})
+	return groups
+}
+
+func formatAlertRecord(record *slog.Record) string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "%-5s[%s] %-40s\t", record.Level, record.Time.Format("2006-01-02 15:04:05.99"), record.Message)
+	record.Attrs(func(attr slog.Attr) bool {
+		fmt.Fprintf(b, "%s=%v\t", attr.Key, attr.Value)
+		return true
+	})
+	return b.String()
+}
+
+func formatAlertGroups(groups []*AlertGroup, maxGroups int) string {
+	b := &strings.Builder{}
+	for i, g := range groups {
+		if i == maxGroups {
+			fmt.Fprintf(b, "其余 %d 组未显示\n", len(groups)-maxGroups)
+			break
+		}
+		fmt.Fprintf(b, "[%d次] %s", g.Count, g.Message)
+		for _, label := range g.Labels {
+			fmt.Fprintf(b, " %s=%v", label.Key, label.Value)
+		}
+		fmt.Fprintf(b, "  首次 %s 最近 %s\n", g.FirstSeen.Format("15:04:05"), g.LastSeen.Format("15:04:05"))
+		for _, example := range g.Examples {
+			b.WriteString("  例: ")
+			b.WriteString(formatAlertRecord(example))
+			b.WriteByte('\n')
+		}
+	}
+	return b.String()
+}
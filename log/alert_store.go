@@ -0,0 +1,102 @@
+package log
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// AlertSnapshot is the part of the alert of a Metric that survives a restart.
+type AlertSnapshot struct {
+	State        AlertState `json:"state"`
+	LastNotify   time.Time  `json:"last_notify"`
+	NextNotify   time.Time  `json:"next_notify"` // 在此之前不再重复通知
+	PendingSince time.Time  `json:"pending_since"`
+	FiringSince  time.Time  `json:"firing_since"`
+	Peak         int        `json:"peak"`
+}
+
+// AlertStore persists the alerts of metrics by their name.
+type AlertStore interface {
+	// Load returns nil without an error if nothing was saved for name.
+	Load(name string) (*AlertSnapshot, error)
+	Save(name string, snapshot *AlertSnapshot) error
+}
+
+// FileAlertStore keeps the alerts of all metrics in one JSON file.
+type FileAlertStore struct {
+	Filename string
+	mu       sync.Mutex
+	alerts   map[string]*AlertSnapshot
+}
+
+func (s *FileAlertStore) load() error {
+	if s.alerts != nil {
+		return nil
+	}
+	alerts := make(map[string]*AlertSnapshot)
+	data, err := os.ReadFile(s.Filename)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &alerts); err != nil {
+			return err
+		}
+	}
+	s.alerts = alerts
+	return nil
+}
+
+func (s *FileAlertStore) Load(name string) (*AlertSnapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if snapshot, ok := s.alerts[name]; ok {
+		copied := *snapshot
+		return &copied, nil
+	}
+	return nil, nil
+}
+
+// Save writes the whole file through a temporary file, so that a crash never
+// leaves it half written.
+func (s *FileAlertStore) Save(name string, snapshot *AlertSnapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	copied := *snapshot
+	s.alerts[name] = &copied
+	data, err := json.MarshalIndent(s.alerts, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.Filename), filepath.Base(s.Filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Filename)
+}
+
+func NewFileAlertStore(filename string) *FileAlertStore {
+	return &FileAlertStore{Filename: filename}
+}
@@ -0,0 +1,149 @@
+package log
+
+import (
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Formats of notification content, matching the constants of package notify.
+const (
+	FormatHTML     = "html"
+	FormatMarkdown = "markdown"
+	FormatText     = "text"
+)
+
+// NotifyFormat is implemented by notifiers that declare the content format
+// they accept. Notifiers without it get FormatHTML.
+type NotifyFormat interface {
+	Format() string
+}
+
+// AlertTemplate renders AlertData, both *template.Template of text/template
+// and of html/template implement it.
+type AlertTemplate interface {
+	Execute(w io.Writer, data any) error
+}
+
+// AlertData is passed to alert templates.
+type AlertData struct {
+	Title     string // Metric.Name
+	Status    AlertState
+	Time      time.Time
+	Count     int           // EvaluatePeriod 内的日志数量
+	Threshold int           // 触发阈值
+	Peak      int           // 触发以来的最大数量
+	Window    time.Duration // EvaluatePeriod
+	Duration  time.Duration // 已触发的时间
+	Groups    []*AlertGroup // 最多 MaxGroups 组
+	Hidden    int           // 未显示的分组数量
+	Message   string        // 纯文本形式的内容
+}
+
+// AlertFuncs are the helper functions available in alert templates.
+var AlertFuncs = map[string]any{
+	"level": func(l slog.Level) string {
+		return strings.TrimSpace(LevelAlignedString(l))
+	},
+	"formatTime": func(t time.Time, layout ...string) string {
+		if len(layout) > 0 {
+			return t.Format(layout[0])
+		}
+		return t.Format(time.DateTime)
+	},
+	"duration": func(d time.Duration) string {
+		return d.Round(time.Second).String()
+	},
+	"attrs": func(r *slog.Record) string {
+		var attrs []string
+		r.Attrs(func(attr slog.Attr) bool {
+			attrs = append(attrs, fmt.Sprintf("%s=%v", attr.Key, attr.Value))
+			return true
+		})
+		return strings.Join(attrs, " ")
+	},
+	"labels": func(labels []slog.Attr) string {
+		var attrs []string
+		for _, attr := range labels {
+			attrs = append(attrs, fmt.Sprintf("%s=%v", attr.Key, attr.Value))
+		}
+		return strings.Join(attrs, " ")
+	},
+	"resolved": func(s AlertState) bool {
+		return s == AlertResolved
+	},
+}
+
+var (
+	DefaultMarkdownTemplate = template.Must(template.New("markdown").Funcs(AlertFuncs).Parse(
+		`**{{.Title}}** {{if resolved .Status}}已恢复{{else}}告警{{end}}
+
+{{if resolved .Status -}}
+- 持续时间: {{duration .Duration}}
+- 峰值: {{.Peak}} 条/{{duration .Window}}
+{{else -}}
+- {{duration .Window}} 内 {{.Count}} 条日志，阈值 {{.Threshold}}，已持续 {{duration .Duration}}
+{{range .Groups}}
+**[{{.Count}}次] {{.Message}}**{{with labels .Labels}} {{.}}{{end}}
+首次 {{formatTime .FirstSeen "15:04:05"}} 最近 {{formatTime .LastSeen "15:04:05"}}
+{{range .Examples}}` + "```" + `
+{{level .Level}} {{.Message}} {{attrs .}}
+` + "```" + `
+{{end}}{{end}}{{if .Hidden}}
+其余 {{.Hidden}} 组未显示
+{{end}}{{end}}
+> {{formatTime .Time}}
+`))
+
+	DefaultTextTemplate = template.Must(template.New("text").Funcs(AlertFuncs).Parse(
+		`{{if resolved .Status -}}
+告警已恢复
+持续时间: {{duration .Duration}}
+峰值: {{.Peak}} 条/{{duration .Window}}
+{{else -}}
+{{duration .Window}} 内 {{.Count}} 条日志，阈值 {{.Threshold}}，已持续 {{duration .Duration}}
+{{range .Groups}}
+[{{.Count}}次] {{.Message}}{{with labels .Labels}} {{.}}{{end}}
+首次 {{formatTime .FirstSeen "15:04:05"}} 最近 {{formatTime .LastSeen "15:04:05"}}
+{{range .Examples}}  {{level .Level}} {{.Message}} {{attrs .}}
+{{end}}{{end}}{{if .Hidden}}
+其余 {{.Hidden}} 组未显示
+{{end}}{{end}}
+{{formatTime .Time}}
+`))
+)
+
+// DefaultTemplates maps every format to the template used when a Metric has
+// none of its own.
+var DefaultTemplates = map[string]AlertTemplate{
+	FormatHTML:     DefaultTemplate,
+	FormatMarkdown: DefaultMarkdownTemplate,
+	FormatText:     DefaultTextTemplate,
+}
+
+// ParseAlertTemplateFile parses a user template for the given format. HTML
+// templates are parsed by html/template, so that values are escaped.
+func ParseAlertTemplateFile(format string, filename string) (AlertTemplate, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Base(filename)
+	if format == FormatHTML {
+		return htmltemplate.New(name).Funcs(AlertFuncs).Parse(string(data))
+	}
+	return template.New(name).Funcs(AlertFuncs).Parse(string(data))
+}
+
+func notifyFormat(n Notify) string {
+	if f, ok := n.(NotifyFormat); ok {
+		return f.Format()
+	}
+	return FormatHTML
+}
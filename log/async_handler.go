@@ -0,0 +1,203 @@
+package log
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DropPolicy decides what AsyncHandler does with a record when its queue is full.
+type DropPolicy int
+
+const (
+	Block      DropPolicy = iota // 等待队列有空位
+	DropNewest                   // 丢弃当前日志
+	DropOldest                   // 丢弃队列中最早的日志，队列中只有 Flush 时丢弃当前日志
+)
+
+type asyncEntry struct {
+	ctx     context.Context
+	handler slog.Handler
+	record  slog.Record
+	flushed chan struct{} // 非空时表示这是 Flush 的标记
+}
+
+// asyncQueue holds the records waiting for the background goroutine, in the
+// order they were logged, and counts the dropped ones.
+type asyncQueue struct {
+	mu       sync.RWMutex
+	closed   bool
+	entries  chan asyncEntry
+	policy   DropPolicy
+	dropped  atomic.Uint64
+	reported uint64
+	done     chan struct{}
+}
+
+func (q *asyncQueue) push(e asyncEntry) bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return false
+	}
+	switch q.policy {
+	case DropNewest:
+		select {
+		case q.entries <- e:
+		default:
+			if e.flushed == nil {
+				q.dropped.Add(1)
+				return true
+			}
+			q.entries <- e
+		}
+	case DropOldest:
+		if e.flushed != nil {
+			q.entries <- e
+			return true
+		}
+		// One pass over the queue at most, if it holds nothing but markers
+		// the record is dropped instead of waiting for the worker.
+		for i := 0; i <= cap(q.entries); i++ {
+			select {
+			case q.entries <- e:
+				return true
+			default:
+			}
+			select {
+			case old := <-q.entries:
+				if old.flushed != nil {
+					// A marker is never dropped, the records before it may
+					// still be written. Queued again it waits for a few more.
+					q.entries <- old
+				} else {
+					q.dropped.Add(1)
+				}
+			default:
+			}
+		}
+		q.dropped.Add(1)
+	default:
+		q.entries <- e
+	}
+	return true
+}
+
+func (q *asyncQueue) run(base slog.Handler) {
+	defer close(q.done)
+	for e := range q.entries {
+		if e.flushed != nil {
+			close(e.flushed)
+			continue
+		}
+		e.handler.Handle(e.ctx, e.record)
+		if len(q.entries) == 0 {
+			q.reportDropped(base)
+		}
+	}
+	q.reportDropped(base)
+}
+
+// reportDropped logs how many records were dropped since the last report.
+func (q *asyncQueue) reportDropped(h slog.Handler) {
+	dropped := q.dropped.Load()
+	if dropped == q.reported {
+		return
+	}
+	r := slog.NewRecord(time.Now(), slog.LevelWarn, "Dropped log records", 0)
+	r.AddAttrs(slog.Uint64("count", dropped-q.reported), slog.Uint64("total", dropped))
+	q.reported = dropped
+	if h.Enabled(context.Background(), r.Level) {
+		h.Handle(context.Background(), r)
+	}
+}
+
+// AsyncHandler hands records to a background goroutine that passes them on to
+// the wrapped handler, so a slow writer no longer stalls the callers.
+type AsyncHandler struct {
+	handler slog.Handler
+	queue   *asyncQueue
+}
+
+func (a *AsyncHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return a.handler.Enabled(ctx, level)
+}
+
+func (a *AsyncHandler) Handle(ctx context.Context, r slog.Record) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	e := asyncEntry{
+		ctx:     context.WithoutCancel(ctx),
+		handler: a.handler,
+		record:  r.Clone(),
+	}
+	if !a.queue.push(e) {
+		// 已关闭，直接同步写入
+		return a.handler.Handle(ctx, r)
+	}
+	return nil
+}
+
+func (a *AsyncHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &AsyncHandler{
+		handler: a.handler.WithAttrs(attrs),
+		queue:   a.queue,
+	}
+}
+
+func (a *AsyncHandler) WithGroup(name string) slog.Handler {
+	return &AsyncHandler{
+		handler: a.handler.WithGroup(name),
+		queue:   a.queue,
+	}
+}
+
+func (a *AsyncHandler) handlers() []slog.Handler {
+	return []slog.Handler{a.handler}
+}
+
+// Dropped returns the number of records dropped because the queue was full.
+func (a *AsyncHandler) Dropped() uint64 {
+	return a.queue.dropped.Load()
+}
+
+// Flush waits until every record queued before the call has been handled.
+func (a *AsyncHandler) Flush() error {
+	flushed := make(chan struct{})
+	if a.queue.push(asyncEntry{flushed: flushed}) {
+		<-flushed
+	}
+	return nil
+}
+
+// Close handles the remaining records and stops the background goroutine.
+// Records logged after Close are written synchronously.
+func (a *AsyncHandler) Close() error {
+	a.queue.mu.Lock()
+	if !a.queue.closed {
+		a.queue.closed = true
+		close(a.queue.entries)
+	}
+	a.queue.mu.Unlock()
+	<-a.queue.done
+	return nil
+}
+
+func NewAsyncHandler(h slog.Handler, size int, policy DropPolicy) *AsyncHandler {
+	if size <= 0 {
+		size = 1024
+	}
+	queue := &asyncQueue{
+		entries: make(chan asyncEntry, size),
+		policy:  policy,
+		done:    make(chan struct{}),
+	}
+	go queue.run(h)
+	return &AsyncHandler{
+		handler: h,
+		queue:   queue,
+	}
+}
@@ -0,0 +1,173 @@
+package log
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+)
+
+const (
+	RequestIDKey = "request_id"
+	TraceIDKey   = "trace_id"
+)
+
+type loggerKey struct{}
+
+type attrsKey struct{}
+
+// WithContext returns a copy of ctx carrying l. A nil ctx is taken as
+// context.Background().
+func WithContext(ctx context.Context, l Logger) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// FromContext returns the Logger stored by WithContext, or the root logger.
+func FromContext(ctx context.Context) Logger {
+	if ctx != nil {
+		if l, ok := ctx.Value(loggerKey{}).(Logger); ok {
+			return l
+		}
+	}
+	return Root()
+}
+
+// ContextWithAttrs returns a copy of ctx carrying the given key/value pairs or
+// slog.Attr values in addition to those already stored. ContextAttrs turns
+// them into record attributes. A nil ctx is taken as context.Background().
+func ContextWithAttrs(ctx context.Context, args ...any) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	prev, _ := ctx.Value(attrsKey{}).([]slog.Attr)
+	r := slog.Record{}
+	r.Add(args...)
+	attrs := make([]slog.Attr, len(prev), len(prev)+r.NumAttrs())
+	copy(attrs, prev)
+	r.Attrs(func(attr slog.Attr) bool {
+		attrs = append(attrs, attr)
+		return true
+	})
+	return context.WithValue(ctx, attrsKey{}, attrs)
+}
+
+// WithRequestID is a shorthand for ContextWithAttrs(ctx, RequestIDKey, id).
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return ContextWithAttrs(ctx, RequestIDKey, id)
+}
+
+// WithTraceID is a shorthand for ContextWithAttrs(ctx, TraceIDKey, id).
+func WithTraceID(ctx context.Context, id string) context.Context {
+	return ContextWithAttrs(ctx, TraceIDKey, id)
+}
+
+// ContextExtractor returns the attributes to add to a record logged with ctx.
+type ContextExtractor func(ctx context.Context) []slog.Attr
+
+// ContextAttrs is the ContextExtractor for attributes stored by ContextWithAttrs.
+func ContextAttrs(ctx context.Context) []slog.Attr {
+	if ctx == nil {
+		return nil
+	}
+	attrs, _ := ctx.Value(attrsKey{}).([]slog.Attr)
+	return attrs
+}
+
+// contextGroup is a group opened by WithGroup with the attributes added to it.
+type contextGroup struct {
+	name  string
+	attrs []slog.Attr
+}
+
+// ContextHandler adds the attributes returned by its extractors to every
+// record before passing it on. They are top level attributes even when a
+// group was opened by WithGroup.
+type ContextHandler struct {
+	handler    slog.Handler
+	base       slog.Handler   // 第一个分组之前的 handler
+	groups     []contextGroup // base 之后打开的分组
+	extractors []ContextExtractor
+}
+
+func (c *ContextHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return c.handler.Enabled(ctx, level)
+}
+
+func (c *ContextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if ctx == nil {
+		return c.handler.Handle(ctx, r)
+	}
+	var attrs []slog.Attr
+	for _, extract := range c.extractors {
+		attrs = append(attrs, extract(ctx)...)
+	}
+	if len(attrs) == 0 {
+		return c.handler.Handle(ctx, r)
+	}
+	if len(c.groups) == 0 {
+		// The caller may still use the attributes of r.
+		r = r.Clone()
+		r.AddAttrs(attrs...)
+		return c.handler.Handle(ctx, r)
+	}
+	// Attributes of the record would end up in the open group, so they are
+	// added before it and the groups are opened again.
+	h := c.base.WithAttrs(attrs)
+	for _, group := range c.groups {
+		h = h.WithGroup(group.name)
+		if len(group.attrs) > 0 {
+			h = h.WithAttrs(group.attrs)
+		}
+	}
+	return h.Handle(ctx, r)
+}
+
+func (c *ContextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(c.groups) == 0 {
+		handler := c.handler.WithAttrs(attrs)
+		return &ContextHandler{
+			handler:    handler,
+			base:       handler,
+			extractors: c.extractors,
+		}
+	}
+	groups := slices.Clone(c.groups)
+	last := &groups[len(groups)-1]
+	last.attrs = append(last.attrs[:len(last.attrs):len(last.attrs)], attrs...)
+	return &ContextHandler{
+		handler:    c.handler.WithAttrs(attrs),
+		base:       c.base,
+		groups:     groups,
+		extractors: c.extractors,
+	}
+}
+
+func (c *ContextHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return c
+	}
+	return &ContextHandler{
+		handler:    c.handler.WithGroup(name),
+		base:       c.base,
+		groups:     append(c.groups[:len(c.groups):len(c.groups)], contextGroup{name: name}),
+		extractors: c.extractors,
+	}
+}
+
+func (c *ContextHandler) handlers() []slog.Handler {
+	return []slog.Handler{c.handler}
+}
+
+// NewContextHandler wraps h, when no extractor is given ContextAttrs is used.
+func NewContextHandler(h slog.Handler, extractors ...ContextExtractor) *ContextHandler {
+	if len(extractors) == 0 {
+		extractors = []ContextExtractor{ContextAttrs}
+	}
+	return &ContextHandler{
+		handler:    h,
+		base:       h,
+		extractors: extractors,
+	}
+}
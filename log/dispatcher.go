@@ -0,0 +1,221 @@
+package log
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	defaultDispatcher     *Dispatcher
+	defaultDispatcherOnce sync.Once
+)
+
+// ErrDispatcherClosed is returned by Dispatch after Close.
+var ErrDispatcherClosed = errors.New("dispatcher closed")
+
+// NotifyContext is implemented by notifiers that report delivery errors and
+// return once ctx is done, which is required for timeouts and retries. A
+// plain Notify is called once without a timeout.
+type NotifyContext interface {
+	SendContext(ctx context.Context, title string, content string) error
+}
+
+// DeliveryStats counts the notifications handled by a Dispatcher.
+type DeliveryStats struct {
+	Queued  uint64 `json:"queued"`
+	Sent    uint64 `json:"sent"`
+	Failed  uint64 `json:"failed"`  // 重试后仍然失败
+	Retried uint64 `json:"retried"` // 重试次数
+	Dropped uint64 `json:"dropped"` // 队列已满被丢弃
+}
+
+type delivery struct {
+	notify  Notify
+	title   string
+	content string
+}
+
+// Dispatcher delivers notifications from a bounded queue on background
+// workers, so that alerting never blocks the goroutine that logs.
+type Dispatcher struct {
+	Timeout    time.Duration // 单次发送超时
+	Retries    int           // 失败后的重试次数
+	Backoff    time.Duration // 第一次重试前的等待时间，之后每次翻倍
+	MaxBackoff time.Duration
+
+	queue   chan delivery
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending int
+	closed  bool
+	flushes int           // 正在等待的 Flush 调用数
+	hurry   chan struct{} // Flush 或 Close 时关闭，中断重试前的等待
+	wg      sync.WaitGroup
+
+	queued, sent, failed, retried, dropped atomic.Uint64
+}
+
+// Dispatch queues a notification, it is dropped if the queue is full.
+func (d *Dispatcher) Dispatch(n Notify, title string, content string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return ErrDispatcherClosed
+	}
+	select {
+	case d.queue <- delivery{notify: n, title: title, content: content}:
+		d.pending++
+		d.queued.Add(1)
+		return nil
+	default:
+		d.dropped.Add(1)
+		return fmt.Errorf("notification queue full, dropped %q", title)
+	}
+}
+
+func (d *Dispatcher) work() {
+	defer d.wg.Done()
+	for item := range d.queue {
+		d.deliver(item)
+		d.mu.Lock()
+		d.pending--
+		if d.pending == 0 {
+			d.cond.Broadcast()
+		}
+		d.mu.Unlock()
+	}
+}
+
+func (d *Dispatcher) deliver(item delivery) {
+	n, ok := item.notify.(NotifyContext)
+	if !ok {
+		// Send can be neither interrupted nor told to have failed, so it
+		// is called once on the worker: an abandoned call that is still
+		// running must not be followed by a second one.
+		item.notify.Send(item.title, item.content)
+		d.sent.Add(1)
+		return
+	}
+	backoff := d.Backoff
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), d.Timeout)
+		err := n.SendContext(ctx, item.title, item.content)
+		cancel()
+		if err == nil {
+			d.sent.Add(1)
+			return
+		}
+		// Flush and Close give up the remaining retries rather than wait.
+		if attempt >= d.Retries || !d.wait(backoff) {
+			d.failed.Add(1)
+			// Not logged, an error record could trigger the next alert.
+			fmt.Fprintf(os.Stderr, "deliver notification %q error: %v\n", item.title, err)
+			return
+		}
+		d.retried.Add(1)
+		backoff = min(backoff*2, d.MaxBackoff)
+	}
+}
+
+// wait sleeps for d and reports whether it was not cut short by Flush or
+// Close.
+func (d *Dispatcher) wait(backoff time.Duration) bool {
+	d.mu.Lock()
+	hurry := d.hurry
+	d.mu.Unlock()
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-hurry:
+		return false
+	}
+}
+
+// setHurry closes hurry while a Flush waits or after Close, and renews it
+// once the last Flush returned. d.mu must be held.
+func (d *Dispatcher) setHurry() {
+	hurried := d.closed || d.flushes > 0
+	select {
+	case <-d.hurry:
+		if !hurried {
+			d.hurry = make(chan struct{})
+		}
+	default:
+		if hurried {
+			close(d.hurry)
+		}
+	}
+}
+
+func (d *Dispatcher) Stats() DeliveryStats {
+	return DeliveryStats{
+		Queued:  d.queued.Load(),
+		Sent:    d.sent.Load(),
+		Failed:  d.failed.Load(),
+		Retried: d.retried.Load(),
+		Dropped: d.dropped.Load(),
+	}
+}
+
+// Flush waits until every queued notification was delivered or given up,
+// notifications waiting for a retry are given up.
+func (d *Dispatcher) Flush() error {
+	d.mu.Lock()
+	d.flushes++
+	d.setHurry()
+	for d.pending > 0 {
+		d.cond.Wait()
+	}
+	d.flushes--
+	d.setHurry()
+	d.mu.Unlock()
+	return nil
+}
+
+// Close delivers the queued notifications without retries and stops the
+// workers.
+func (d *Dispatcher) Close() error {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.queue)
+		d.setHurry()
+	}
+	d.mu.Unlock()
+	d.wg.Wait()
+	return nil
+}
+
+// NewDispatcher starts workers goroutines delivering from a queue of size
+// notifications, with a 10s timeout and 3 retries starting at 1s.
+func NewDispatcher(size int, workers int) *Dispatcher {
+	d := &Dispatcher{
+		Timeout:    10 * time.Second,
+		Retries:    3,
+		Backoff:    time.Second,
+		MaxBackoff: time.Minute,
+		queue:      make(chan delivery, max(size, 1)),
+		hurry:      make(chan struct{}),
+	}
+	d.cond = sync.NewCond(&d.mu)
+	d.wg.Add(max(workers, 1))
+	for i := 0; i < max(workers, 1); i++ {
+		go d.work()
+	}
+	return d
+}
+
+// DefaultDispatcher is used by metrics without a Dispatcher of their own.
+func DefaultDispatcher() *Dispatcher {
+	defaultDispatcherOnce.Do(func() {
+		defaultDispatcher = NewDispatcher(100, 2)
+	})
+	return defaultDispatcher
+}
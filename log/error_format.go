@@ -0,0 +1,154 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// joinedErrors returns the errors of errors.Join or of fmt.Errorf with
+// several %w verbs.
+func joinedErrors(err error) ([]error, bool) {
+	if j, ok := err.(interface{ Unwrap() []error }); ok {
+		return j.Unwrap(), true
+	}
+	return nil, false
+}
+
+// hasErrorChain reports whether err wraps other errors, such errors are
+// written as a tree by TerminalHandler, JSONHandler adds an array of the
+// chain next to the message.
+func hasErrorChain(err error) bool {
+	if _, ok := joinedErrors(err); ok {
+		return true
+	}
+	return errors.Unwrap(err) != nil
+}
+
+// blockValue reports whether v is written below the record line by
+// TerminalHandler, and whether it is written in the line itself as well.
+func blockValue(v slog.Value) (block bool, inline bool) {
+	if v.Kind() != slog.KindAny {
+		return false, true
+	}
+	switch v := v.Any().(type) {
+	case Stack:
+		return true, false
+	case error:
+		if v != nil && hasErrorChain(v) {
+			// The tree starts with the message, so it is only written there.
+			return true, false
+		}
+	}
+	return false, true
+}
+
+// writeBlock writes a stack or an error tree below the record line.
+func writeBlock(b *bytes.Buffer, attr slog.Attr, color string) {
+	b.WriteString("  ")
+	if color != "" {
+		b.WriteString(color)
+		b.WriteString(attr.Key)
+		b.WriteString(colorReset)
+	} else {
+		b.WriteString(attr.Key)
+	}
+	b.WriteByte(':')
+	switch v := attr.Value.Any().(type) {
+	case Stack:
+		b.WriteByte('\n')
+		for _, frame := range v.Frames() {
+			b.WriteString("    ")
+			b.WriteString(shortFuncName(frame.Function))
+			b.WriteString("\n        ")
+			b.WriteString(frame.File)
+			b.WriteByte(':')
+			b.WriteString(strconv.Itoa(frame.Line))
+			b.WriteByte('\n')
+		}
+	case error:
+		writeErrorTree(b, v, 1, " ")
+	}
+}
+
+// writeErrorTree writes err on a line of its own, followed by the errors it
+// wraps indented below it:
+//
+//	err: 2 errors
+//	  [0] read config: open app.toml: permission denied
+//	    caused by: open app.toml: permission denied
+//	    caused by: permission denied
+//	  [1] connection refused
+func writeErrorTree(b *bytes.Buffer, err error, depth int, prefix string) {
+	indent := strings.Repeat("  ", depth)
+	if errs, ok := joinedErrors(err); ok {
+		b.WriteString(prefix)
+		b.WriteString(strconv.Itoa(len(errs)))
+		b.WriteString(" errors\n")
+		for i, e := range errs {
+			if e == nil {
+				continue
+			}
+			writeErrorTree(b, e, depth+1, indent+"  ["+strconv.Itoa(i)+"] ")
+		}
+		return
+	}
+	b.WriteString(prefix)
+	b.WriteString(errorLine(err))
+	b.WriteByte('\n')
+	for e := errors.Unwrap(err); e != nil; e = errors.Unwrap(e) {
+		if _, ok := joinedErrors(e); ok {
+			writeErrorTree(b, e, depth+1, indent+"  caused by: ")
+			return
+		}
+		b.WriteString(indent)
+		b.WriteString("  caused by: ")
+		b.WriteString(errorLine(e))
+		b.WriteByte('\n')
+	}
+}
+
+// errorLine keeps the message of an error wrapping joined errors on one line.
+func errorLine(err error) string {
+	return strings.ReplaceAll(err.Error(), "\n", "; ")
+}
+
+// jsonChainSuffix is appended to the key of an error to name its chain.
+const jsonChainSuffix = "_chain"
+
+// appendJSONError writes the chain of an error: a plain error as its message,
+// joined errors as an array of their errors, a wrapped error as an array of
+// the messages along its chain, outermost first.
+func appendJSONError(buf []byte, err error) []byte {
+	if errs, ok := joinedErrors(err); ok {
+		buf = append(buf, '[')
+		first := true
+		for _, e := range errs {
+			if e == nil {
+				continue
+			}
+			if !first {
+				buf = append(buf, ',')
+			}
+			first = false
+			buf = appendJSONError(buf, e)
+		}
+		return append(buf, ']')
+	}
+	if errors.Unwrap(err) == nil {
+		return appendJSONString(buf, err.Error())
+	}
+	buf = append(buf, '[')
+	buf = appendJSONString(buf, err.Error())
+	for e := errors.Unwrap(err); e != nil; e = errors.Unwrap(e) {
+		buf = append(buf, ',')
+		if _, ok := joinedErrors(e); ok {
+			buf = appendJSONError(buf, e)
+			break
+		}
+		buf = appendJSONString(buf, e.Error())
+	}
+	return append(buf, ']')
+}
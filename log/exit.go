@@ -0,0 +1,137 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// ExitTimeout bounds each step of Fatal and Exit: flushing the handlers,
+// running the exit hooks and flushing the records the hooks logged. A step
+// that takes longer is abandoned and the next one starts. Panic waits as long
+// for its flush.
+var ExitTimeout = 5 * time.Second
+
+var (
+	exitMu    sync.Mutex
+	exitHooks []func()
+	osExit    = os.Exit
+)
+
+// Flusher is implemented by handlers that buffer records, such as
+// AsyncHandler. Handlers that hold resources implement io.Closer as well.
+type Flusher interface {
+	Flush() error
+}
+
+// wrappingHandler is implemented by the handlers of this package that pass
+// records on to other handlers, so that flushing and closing reach them.
+type wrappingHandler interface {
+	handlers() []slog.Handler
+}
+
+// walkHandlers calls fn for h and then for the handlers it wraps, so that a
+// buffering handler is drained before the handlers behind it.
+func walkHandlers(h slog.Handler, fn func(h slog.Handler) error) error {
+	err := fn(h)
+	if w, ok := h.(wrappingHandler); ok {
+		for _, inner := range w.handlers() {
+			err = errors.Join(err, walkHandlers(inner, fn))
+		}
+	}
+	return err
+}
+
+// FlushHandler flushes h and every handler it wraps.
+func FlushHandler(h slog.Handler) error {
+	return walkHandlers(h, func(h slog.Handler) error {
+		if f, ok := h.(Flusher); ok {
+			return f.Flush()
+		}
+		return nil
+	})
+}
+
+// CloseHandler closes h and every handler it wraps. Handlers that can only be
+// flushed are flushed.
+func CloseHandler(h slog.Handler) error {
+	return walkHandlers(h, func(h slog.Handler) error {
+		switch c := h.(type) {
+		case interface{ Close() error }:
+			return c.Close()
+		case Flusher:
+			return c.Flush()
+		}
+		return nil
+	})
+}
+
+// RegisterExitHook adds a hook run by Fatal and Exit before the process
+// exits. Hooks run in the reverse order of registration, like deferred calls.
+func RegisterExitHook(hook func()) {
+	exitMu.Lock()
+	exitHooks = append(exitHooks, hook)
+	exitMu.Unlock()
+}
+
+// Exit flushes the handlers of the root logger, runs the exit hooks, flushes
+// again and exits with code.
+func Exit(code int) {
+	exit(Root().Handler(), code)
+}
+
+func exit(h slog.Handler, code int) {
+	exitMu.Lock()
+	hooks := exitHooks
+	exitHooks = nil
+	exitMu.Unlock()
+
+	// The record of Fatal is written before a slow hook can hold it up, the
+	// records logged by the hooks after them.
+	flushBeforeExit(h)
+	if len(hooks) > 0 {
+		withExitTimeout("exit hooks", func() {
+			for i := len(hooks) - 1; i >= 0; i-- {
+				runExitHook(hooks[i])
+			}
+		})
+		flushBeforeExit(h)
+	}
+	osExit(code)
+}
+
+// flushBeforeExit flushes h, waiting at most ExitTimeout.
+func flushBeforeExit(h slog.Handler) {
+	withExitTimeout("flush log handlers", func() {
+		if err := FlushHandler(h); err != nil {
+			fmt.Fprintln(os.Stderr, "flush log handler error:", err)
+		}
+	})
+}
+
+func withExitTimeout(what string, fn func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+	timer := time.NewTimer(ExitTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		fmt.Fprintln(os.Stderr, what, "timed out after", ExitTimeout)
+	}
+}
+
+func runExitHook(hook func()) {
+	defer func() {
+		if err := recover(); err != nil {
+			fmt.Fprintln(os.Stderr, "exit hook panic:", err)
+		}
+	}()
+	hook()
+}
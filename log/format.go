@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"log/slog"
 	"math/big"
+	"path/filepath"
 	"reflect"
+	"runtime"
 	"strconv"
+	"strings"
 	"time"
 	"unicode/utf8"
 )
@@ -26,21 +29,12 @@ type TerminalStringer interface {
 
 func (t *TerminalHandler) format(buf []byte, r slog.Record, useColor bool) []byte {
 	msg := escapeMessage(r.Message)
-	var color = ""
+	var color, keyColor string
 	if useColor {
-		switch r.Level {
-		case LevelFatal:
-			color = "\x1b[35m"
-		case slog.LevelError:
-			color = "\x1b[31m"
-		case slog.LevelWarn:
-			color = "\x1b[33m"
-		case slog.LevelInfo:
-			color = "\x1b[32m"
-		case slog.LevelDebug:
-			color = "\x1b[36m"
-		case LevelTrace:
-			color = "\x1b[34m"
+		color = t.theme.Levels[r.Level]
+		keyColor = color
+		if t.theme.Key != "" {
+			keyColor = t.theme.Key
 		}
 	}
 	if buf == nil {
@@ -51,24 +45,63 @@ func (t *TerminalHandler) format(buf []byte, r slog.Record, useColor bool) []byt
 	if color != "" {
 		b.WriteString(color)
 		b.WriteString(LevelAlignedString(r.Level))
-		b.WriteString("\x1b[0m")
+		b.WriteString(colorReset)
 	} else {
 		b.WriteString(LevelAlignedString(r.Level))
 	}
 	b.WriteString("[")
-	writeTimeTermFormat(b, r.Time)
+	t.writeTime(b, r.Time)
 	b.WriteString("] ")
+	if t.caller != CallerNone && r.PC != 0 {
+		t.writeCaller(b, r.PC)
+	}
 	b.WriteString(msg)
 	length := len(msg)
 	if (r.NumAttrs()+len(t.attrs)) > 0 && length < termMsgJust {
 		b.Write(spaces[:termMsgJust-length])
 	}
 
-	t.formatAttributes(b, r, color)
+	t.formatAttributes(b, r, keyColor)
 
 	return b.Bytes()
 }
 
+// writeCaller writes the source location of pc, padded to the widest location
+// seen so far like the attribute values.
+func (t *TerminalHandler) writeCaller(b *bytes.Buffer, pc uintptr) {
+	frame, _ := runtime.CallersFrames([]uintptr{pc}).Next()
+	file := frame.File
+	if t.caller == CallerShort {
+		file = filepath.Base(file)
+	}
+	start := b.Len()
+	b.WriteString(file)
+	b.WriteByte(':')
+	b.WriteString(strconv.Itoa(frame.Line))
+	if t.callerFunc && frame.Function != "" {
+		b.WriteByte(' ')
+		b.WriteString(shortFuncName(frame.Function))
+	}
+	length := utf8.RuneCount(b.Bytes()[start:])
+	if t.callerPadding < length && length <= termCtxMaxPadding {
+		t.callerPadding = length
+	}
+	if t.callerPadding > length {
+		b.Write(spaces[:t.callerPadding-length])
+	}
+	b.WriteByte(' ')
+}
+
+// shortFuncName strips the import path from a function name reported by
+// runtime, "github.com/x/go-tools/utils.LoadLocalDialer" becomes
+// "utils.LoadLocalDialer".
+func shortFuncName(name string) string {
+	if i := strings.LastIndexByte(name, '/'); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
 func (t *TerminalHandler) formatAttributes(buf *bytes.Buffer, r slog.Record, color string) {
 	// tmp is a temporary buffer we use, until bytes.Buffer.AvailableBuffer() (1.21)
 	// can be used.
@@ -80,7 +113,8 @@ func (t *TerminalHandler) formatAttributes(buf *bytes.Buffer, r slog.Record, col
 			buf.WriteString(color)
 			//buf.Write(appendEscapeString(buf.AvailableBuffer(), attr.Key))
 			buf.Write(appendEscapeString(tmp[:0], attr.Key))
-			buf.WriteString("\x1b[0m=")
+			buf.WriteString(colorReset)
+			buf.WriteByte('=')
 		} else {
 			//buf.Write(appendEscapeString(buf.AvailableBuffer(), attr.Key))
 			buf.Write(appendEscapeString(tmp[:0], attr.Key))
@@ -101,18 +135,34 @@ func (t *TerminalHandler) formatAttributes(buf *bytes.Buffer, r slog.Record, col
 			buf.Write(spaces[:padding-length])
 		}
 	}
-	var n = 0
-	var nAttrs = len(t.attrs) + r.NumAttrs()
-	for _, attr := range t.attrs {
-		writeAttr(attr, n == 0, n == nAttrs-1)
-		n++
-	}
+	attrs := append(t.flat[:0], t.attrs...)
 	r.Attrs(func(attr slog.Attr) bool {
-		writeAttr(attr, n == 0, n == nAttrs-1)
-		n++
+		attrs = appendFlatAttrs(attrs, t.group, attr)
 		return true
 	})
+	// Stacks and wrapped errors are written below the line instead of in
+	// it.
+	var blocks []slog.Attr
+	n := 0
+	for _, attr := range attrs {
+		block, inline := blockValue(attr.Value)
+		if block {
+			blocks = append(blocks, attr)
+		}
+		if inline {
+			attrs[n] = attr
+			n++
+		}
+	}
+	attrs = attrs[:n]
+	for i, attr := range attrs {
+		writeAttr(attr, i == 0, i == len(attrs)-1)
+	}
+	t.flat = attrs[:0]
 	buf.WriteByte('\n')
+	for _, attr := range blocks {
+		writeBlock(buf, attr, color)
+	}
 }
 
 func FormatSlogValue(v slog.Value, tmp []byte) (result []byte) {
@@ -127,6 +177,7 @@ func FormatSlogValue(v slog.Value, tmp []byte) (result []byte) {
 		}
 	}()
 
+	v = v.Resolve()
 	switch v.Kind() {
 	case slog.KindString:
 		return appendEscapeString(tmp, v.String())
@@ -145,6 +196,8 @@ func FormatSlogValue(v slog.Value, tmp []byte) (result []byte) {
 		// timeFormat doesn't have any escape characters, and escaping is
 		// expensive.
 		return v.Time().AppendFormat(tmp, timeFormat)
+	case slog.KindGroup:
+		return appendGroupValue(tmp, v.Group())
 	default:
 		value = v.Any()
 	}
@@ -168,6 +221,20 @@ func FormatSlogValue(v slog.Value, tmp []byte) (result []byte) {
 	return appendEscapeString(tmp, string(internal))
 }
 
+// appendGroupValue writes the attributes of a group as {key=value ...}.
+func appendGroupValue(dst []byte, attrs []slog.Attr) []byte {
+	dst = append(dst, '{')
+	for i, attr := range attrs {
+		if i > 0 {
+			dst = append(dst, ' ')
+		}
+		dst = appendEscapeString(dst, attr.Key)
+		dst = append(dst, '=')
+		dst = append(dst, FormatSlogValue(attr.Value, nil)...)
+	}
+	return append(dst, '}')
+}
+
 func appendInt64(dst []byte, n int64) []byte {
 	if n < 0 {
 		return appendUint64(dst, uint64(-n), true)
@@ -290,6 +357,17 @@ func escapeMessage(s string) string {
 	return strconv.Quote(s)
 }
 
+func (t *TerminalHandler) writeTime(buf *bytes.Buffer, tm time.Time) {
+	if t.location != nil {
+		tm = tm.In(t.location)
+	}
+	if t.timeFormat == "" {
+		writeTimeTermFormat(buf, tm)
+		return
+	}
+	buf.Write(tm.AppendFormat(buf.AvailableBuffer(), t.timeFormat))
+}
+
 func writeTimeTermFormat(buf *bytes.Buffer, t time.Time) {
 	_, month, day := t.Date()
 	writePosIntWidth(buf, int(month), 2)
@@ -4,19 +4,88 @@ import (
 	"context"
 	"io"
 	"log/slog"
+	"os"
 	"sync"
+	"time"
 )
 
+// CallerFormat selects how TerminalHandler prints the source location of a record.
+type CallerFormat int
+
+const (
+	CallerNone  CallerFormat = iota
+	CallerShort              // dialer.go:87
+	CallerFull               // /path/to/utils/dialer.go:87
+)
+
+// ColorMode selects whether TerminalHandler writes ANSI colors.
+type ColorMode int
+
+const (
+	ColorAuto ColorMode = iota // 输出到终端且未设置 NO_COLOR 时使用颜色
+	ColorAlways
+	ColorNever
+)
+
+const colorReset = "\x1b[0m"
+
+// ColorTheme holds the escape sequences used by TerminalHandler.
+type ColorTheme struct {
+	Levels map[slog.Level]string
+	Key    string // 属性名的颜色，为空时使用日志级别的颜色
+}
+
+var DefaultColorTheme = &ColorTheme{
+	Levels: map[slog.Level]string{
+		LevelFatal:      "\x1b[35m",
+		LevelPanic:      "\x1b[91m",
+		slog.LevelError: "\x1b[31m",
+		slog.LevelWarn:  "\x1b[33m",
+		slog.LevelInfo:  "\x1b[32m",
+		slog.LevelDebug: "\x1b[36m",
+		LevelTrace:      "\x1b[34m",
+	},
+}
+
+// UseColor reports whether colors should be written to w: it must be a
+// terminal and the NO_COLOR environment variable must not be set.
+func UseColor(w io.Writer) bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	f, ok := w.(interface{ Fd() uintptr })
+	return ok && isTerminal(f.Fd())
+}
+
+type TerminalOptions struct {
+	Level      slog.Level
+	Color      ColorMode
+	Theme      *ColorTheme    // 为空时使用 DefaultColorTheme
+	TimeFormat string         // time 包的格式，为空时使用 01-02|15:04:05.000
+	Location   *time.Location // 时间的时区，为空时使用本地时间
+	Caller     CallerFormat   // 显示日志的调用位置
+	CallerFunc bool           // 调用位置后追加函数名
+}
+
 type TerminalHandler struct {
 	mu       sync.Mutex
 	wr       io.Writer
-	lvl      slog.Level
+	lvl      *slog.LevelVar
 	useColor bool
 	attrs    []slog.Attr
+	group    string // key prefix of the open groups, e.g. "http."
+
+	caller     CallerFormat
+	callerFunc bool
+	timeFormat string
+	location   *time.Location
+	theme      *ColorTheme
 
-	fieldPadding map[string]int
+	fieldPadding  map[string]int
+	callerPadding int
 
-	buf []byte
+	buf  []byte
+	flat []slog.Attr
 }
 
 func (t *TerminalHandler) Handle(_ context.Context, r slog.Record) error {
@@ -29,23 +98,85 @@ func (t *TerminalHandler) Handle(_ context.Context, r slog.Record) error {
 }
 
 func (t *TerminalHandler) Enabled(_ context.Context, level slog.Level) bool {
-	return level >= t.lvl
+	return level >= t.lvl.Level()
 }
 
 func (t *TerminalHandler) WithGroup(name string) slog.Handler {
-	panic("not implemented")
+	if name == "" {
+		return t
+	}
+	h := t.clone()
+	h.group = t.group + name + "."
+	return h
 }
 
 func (t *TerminalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h := t.clone()
+	h.attrs = appendFlatAttrs(t.attrs[:len(t.attrs):len(t.attrs)], t.group, attrs...)
+	return h
+}
+
+func (t *TerminalHandler) clone() *TerminalHandler {
 	return &TerminalHandler{
 		wr:           t.wr,
 		lvl:          t.lvl,
 		useColor:     t.useColor,
-		attrs:        append(t.attrs, attrs...),
+		attrs:        t.attrs,
+		group:        t.group,
+		caller:       t.caller,
+		callerFunc:   t.callerFunc,
+		timeFormat:   t.timeFormat,
+		location:     t.location,
+		theme:        t.theme,
 		fieldPadding: make(map[string]int),
 	}
 }
 
+// appendFlatAttrs appends attrs to dst with their keys qualified by prefix.
+// Group values are expanded in place, so that slog.Group("http", "method", "GET")
+// ends up as http.method=GET.
+func appendFlatAttrs(dst []slog.Attr, prefix string, attrs ...slog.Attr) []slog.Attr {
+	for _, attr := range attrs {
+		attr.Value = attr.Value.Resolve()
+		if attr.Equal(slog.Attr{}) {
+			continue
+		}
+		if attr.Value.Kind() == slog.KindGroup {
+			group := prefix
+			if attr.Key != "" {
+				group = prefix + attr.Key + "."
+			}
+			dst = appendFlatAttrs(dst, group, attr.Value.Group()...)
+			continue
+		}
+		attr.Key = prefix + attr.Key
+		dst = append(dst, attr)
+	}
+	return dst
+}
+
+// flattenRecord returns attrs, the attributes of a handler, followed by the
+// attributes of r flattened into group.
+func flattenRecord(attrs []slog.Attr, group string, r slog.Record) []slog.Attr {
+	flat := make([]slog.Attr, 0, len(attrs)+r.NumAttrs())
+	flat = append(flat, attrs...)
+	r.Attrs(func(attr slog.Attr) bool {
+		flat = appendFlatAttrs(flat, group, attr)
+		return true
+	})
+	return flat
+}
+
+// SetLevel changes the minimum level of t, loggers made from it with With or
+// WithGroup follow the change.
+func (t *TerminalHandler) SetLevel(level slog.Level) {
+	t.lvl.Set(level)
+}
+
+func (t *TerminalHandler) Level() slog.Level {
+	return t.lvl.Level()
+}
+
 func (t *TerminalHandler) ResetFieldPadding() {
 	t.mu.Lock()
 	t.fieldPadding = make(map[string]int)
@@ -56,11 +187,32 @@ func NewTerminalHandler(wr io.Writer, useColor bool) *TerminalHandler {
 	return NewTerminalHandlerWithLevel(wr, LevelTrace, useColor)
 }
 
+// NewTerminalHandlerWithLevel creates a TerminalHandler, with useColor set
+// colors are still only used if UseColor(wr) agrees.
 func NewTerminalHandlerWithLevel(wr io.Writer, lvl slog.Level, useColor bool) *TerminalHandler {
+	opts := TerminalOptions{
+		Level: lvl,
+		Color: ColorNever,
+	}
+	if useColor {
+		opts.Color = ColorAuto
+	}
+	return NewTerminalHandlerWithOptions(wr, opts)
+}
+
+func NewTerminalHandlerWithOptions(wr io.Writer, opts TerminalOptions) *TerminalHandler {
+	if opts.Theme == nil {
+		opts.Theme = DefaultColorTheme
+	}
 	return &TerminalHandler{
 		wr:           wr,
-		lvl:          lvl,
-		useColor:     useColor,
+		lvl:          newLevelVar(opts.Level),
+		useColor:     opts.Color == ColorAlways || (opts.Color == ColorAuto && UseColor(wr)),
+		caller:       opts.Caller,
+		callerFunc:   opts.CallerFunc,
+		timeFormat:   opts.TimeFormat,
+		location:     opts.Location,
+		theme:        opts.Theme,
 		fieldPadding: make(map[string]int),
 	}
 }
@@ -0,0 +1,266 @@
+package log
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/big"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	jsonTimeKey  = "time"
+	jsonLevelKey = "level"
+	jsonMsgKey   = "msg"
+)
+
+// jsonFrame holds the attributes added while a group was the innermost open
+// group. The first frame of a handler is the unnamed top level object.
+type jsonFrame struct {
+	name  string
+	attrs []slog.Attr
+}
+
+// JSONHandler writes each record as a single JSON object followed by a newline.
+// Attributes keep the order in which they were added, handler attributes first.
+type JSONHandler struct {
+	mu     sync.Mutex
+	wr     io.Writer
+	lvl    *slog.LevelVar
+	frames []jsonFrame
+
+	buf []byte
+}
+
+func (h *JSONHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	buf := h.format(h.buf, r)
+	_, err := h.wr.Write(buf)
+	h.buf = buf[:0]
+	return err
+}
+
+func (h *JSONHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.lvl.Level()
+}
+
+// SetLevel changes the minimum level, also of the handlers returned by
+// WithAttrs and WithGroup.
+func (h *JSONHandler) SetLevel(level slog.Level) {
+	h.lvl.Set(level)
+}
+
+func (h *JSONHandler) Level() slog.Level {
+	return h.lvl.Level()
+}
+
+func (h *JSONHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	frames := make([]jsonFrame, len(h.frames), len(h.frames)+1)
+	copy(frames, h.frames)
+	return &JSONHandler{
+		wr:     h.wr,
+		lvl:    h.lvl,
+		frames: append(frames, jsonFrame{name: name}),
+	}
+}
+
+func (h *JSONHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(attrs) == 0 {
+		return h
+	}
+	frames := make([]jsonFrame, len(h.frames))
+	copy(frames, h.frames)
+	last := &frames[len(frames)-1]
+	last.attrs = append(last.attrs[:len(last.attrs):len(last.attrs)], attrs...)
+	return &JSONHandler{
+		wr:     h.wr,
+		lvl:    h.lvl,
+		frames: frames,
+	}
+}
+
+func (h *JSONHandler) format(buf []byte, r slog.Record) []byte {
+	buf = append(buf, '{')
+	buf = appendJSONString(buf, jsonTimeKey)
+	buf = append(buf, ':', '"')
+	buf = r.Time.AppendFormat(buf, time.RFC3339Nano)
+	buf = append(buf, '"', ',')
+	buf = appendJSONString(buf, jsonLevelKey)
+	buf = append(buf, ':')
+	buf = appendJSONString(buf, LevelString(r.Level))
+	buf = append(buf, ',')
+	buf = appendJSONString(buf, jsonMsgKey)
+	buf = append(buf, ':')
+	buf = appendJSONString(buf, r.Message)
+	buf = h.appendFrame(buf, 0, r, false)
+	return append(buf, '}', '\n')
+}
+
+// appendFrame writes the attributes of frame i and, nested inside it, all of
+// the following frames and finally the record attributes.
+func (h *JSONHandler) appendFrame(buf []byte, i int, r slog.Record, empty bool) []byte {
+	for _, attr := range h.frames[i].attrs {
+		buf, empty = appendJSONAttr(buf, attr, empty)
+	}
+	if i+1 < len(h.frames) {
+		if !h.hasAttrs(i+1, r) {
+			return buf
+		}
+		if !empty {
+			buf = append(buf, ',')
+		}
+		buf = appendJSONString(buf, h.frames[i+1].name)
+		buf = append(buf, ':', '{')
+		buf = h.appendFrame(buf, i+1, r, true)
+		return append(buf, '}')
+	}
+	r.Attrs(func(attr slog.Attr) bool {
+		buf, empty = appendJSONAttr(buf, attr, empty)
+		return true
+	})
+	return buf
+}
+
+// hasAttrs reports whether frame i or anything nested in it has attributes, so
+// that groups without attributes can be left out like slog does.
+func (h *JSONHandler) hasAttrs(i int, r slog.Record) bool {
+	for ; i < len(h.frames); i++ {
+		if len(h.frames[i].attrs) > 0 {
+			return true
+		}
+	}
+	return r.NumAttrs() > 0
+}
+
+// appendJSONAttr writes attr as a member of the enclosing object. empty tells
+// whether nothing has been written to the object yet, and the updated value is
+// returned.
+func appendJSONAttr(buf []byte, attr slog.Attr, empty bool) ([]byte, bool) {
+	attr.Value = attr.Value.Resolve()
+	if attr.Equal(slog.Attr{}) {
+		return buf, empty
+	}
+	if attr.Value.Kind() == slog.KindGroup {
+		attrs := attr.Value.Group()
+		if len(attrs) == 0 {
+			return buf, empty
+		}
+		if attr.Key == "" {
+			for _, a := range attrs {
+				buf, empty = appendJSONAttr(buf, a, empty)
+			}
+			return buf, empty
+		}
+		if !empty {
+			buf = append(buf, ',')
+		}
+		buf = appendJSONString(buf, attr.Key)
+		buf = append(buf, ':', '{')
+		inner := true
+		for _, a := range attrs {
+			buf, inner = appendJSONAttr(buf, a, inner)
+		}
+		return append(buf, '}'), false
+	}
+	if !empty {
+		buf = append(buf, ',')
+	}
+	buf = appendJSONString(buf, attr.Key)
+	buf = append(buf, ':')
+	buf = appendJSONValue(buf, attr.Value)
+	// The error stays a string, the errors it wraps go into a member of
+	// their own.
+	if err, ok := attr.Value.Any().(error); ok && err != nil && hasErrorChain(err) {
+		buf = append(buf, ',')
+		buf = appendJSONString(buf, attr.Key+jsonChainSuffix)
+		buf = append(buf, ':')
+		buf = appendJSONError(buf, err)
+	}
+	return buf, false
+}
+
+// appendJSONValue renders v the same way FormatSlogValue picks a
+// representation, but as a JSON value.
+func appendJSONValue(buf []byte, v slog.Value) []byte {
+	v = v.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return appendJSONString(buf, v.String())
+	case slog.KindInt64:
+		return strconv.AppendInt(buf, v.Int64(), 10)
+	case slog.KindUint64:
+		return strconv.AppendUint(buf, v.Uint64(), 10)
+	case slog.KindFloat64:
+		f := v.Float64()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return appendJSONString(buf, strconv.FormatFloat(f, floatFormat, -1, 64))
+		}
+		return strconv.AppendFloat(buf, f, floatFormat, -1, 64)
+	case slog.KindBool:
+		return strconv.AppendBool(buf, v.Bool())
+	case slog.KindDuration:
+		return appendJSONString(buf, v.Duration().String())
+	case slog.KindTime:
+		buf = append(buf, '"')
+		buf = v.Time().AppendFormat(buf, time.RFC3339Nano)
+		return append(buf, '"')
+	case slog.KindGroup:
+		buf = append(buf, '{')
+		empty := true
+		for _, attr := range v.Group() {
+			buf, empty = appendJSONAttr(buf, attr, empty)
+		}
+		return append(buf, '}')
+	}
+	value := v.Any()
+	if value == nil {
+		return append(buf, "null"...)
+	}
+	if rv := reflect.ValueOf(value); rv.Kind() == reflect.Ptr && rv.IsNil() {
+		return append(buf, "null"...)
+	}
+	switch value := value.(type) {
+	case *big.Int:
+		return appendJSONString(buf, value.String())
+	case error:
+		return appendJSONString(buf, value.Error())
+	case TerminalStringer:
+		return appendJSONString(buf, value.TerminalString())
+	case json.Marshaler:
+		// Marshalled below, its own representation wins over String.
+	case fmt.Stringer:
+		return appendJSONString(buf, value.String())
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return appendJSONString(buf, fmt.Sprintf("%+v", value))
+	}
+	return append(buf, data...)
+}
+
+func appendJSONString(buf []byte, s string) []byte {
+	data, _ := json.Marshal(s)
+	return append(buf, data...)
+}
+
+func NewJSONHandler(wr io.Writer) *JSONHandler {
+	return NewJSONHandlerWithLevel(wr, LevelTrace)
+}
+
+func NewJSONHandlerWithLevel(wr io.Writer, lvl slog.Level) *JSONHandler {
+	return &JSONHandler{
+		wr:     wr,
+		lvl:    newLevelVar(lvl),
+		frames: []jsonFrame{{}},
+	}
+}
@@ -0,0 +1,15 @@
+package log
+
+import "log/slog"
+
+// Lazy is a value computed only when a handler formats the record, which
+// never happens for disabled levels:
+//
+//	log.Debug("response", "body", log.Lazy(func() any { return dump(resp) }))
+//
+// Behind an AsyncHandler it is called on the background goroutine.
+type Lazy func() any
+
+func (l Lazy) LogValue() slog.Value {
+	return slog.AnyValue(l())
+}
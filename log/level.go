@@ -0,0 +1,194 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+func newLevelVar(level slog.Level) *slog.LevelVar {
+	lvl := new(slog.LevelVar)
+	lvl.Set(level)
+	return lvl
+}
+
+type vmodulePattern struct {
+	pattern  string
+	segments int
+	level    slog.Level
+}
+
+// match reports whether file, as reported by runtime.Frame.File, matches the
+// pattern. Only the trailing path segments are compared, so "utils/dialer.go"
+// matches ".../go-tools/utils/dialer.go".
+func (p *vmodulePattern) match(file string) bool {
+	file = strings.ReplaceAll(file, "\\", "/")
+	if i := len(file); p.segments > 0 {
+		for n := 0; n < p.segments && i > 0; n++ {
+			i = strings.LastIndexByte(file[:i], '/')
+		}
+		file = file[i+1:]
+	}
+	ok, _ := path.Match(p.pattern, file)
+	return ok
+}
+
+// callSite is the cached verbosity of one program counter.
+type callSite struct {
+	level slog.Level
+	ok    bool // false 表示没有匹配的规则，使用默认级别
+}
+
+// levelState holds the default level and the vmodule patterns, and caches
+// for each call site the level of the pattern matching its file.
+type levelState struct {
+	level    slog.LevelVar
+	override atomic.Int64 // 所有规则中最低的级别
+	vmodule  atomic.Bool  // 是否设置了规则
+	mu       sync.RWMutex
+	patterns []vmodulePattern
+	sites    atomic.Pointer[sync.Map] // uintptr -> callSite
+}
+
+func (s *levelState) site(pc uintptr) callSite {
+	if v, ok := s.sites.Load().Load(pc); ok {
+		return v.(callSite)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sites := s.sites.Load()
+	frame, _ := runtime.CallersFrames([]uintptr{pc}).Next()
+	site := callSite{}
+	for i := range s.patterns {
+		if s.patterns[i].match(frame.File) {
+			site = callSite{level: s.patterns[i].level, ok: true}
+			break
+		}
+	}
+	sites.Store(pc, site)
+	return site
+}
+
+// LevelHandler filters records by a level that can be changed at runtime, and
+// optionally by per source file levels in the style of glog's -vmodule.
+type LevelHandler struct {
+	handler slog.Handler
+	state   *levelState
+}
+
+func (h *LevelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	if level < h.state.level.Level() && int64(level) < h.state.override.Load() {
+		return false
+	}
+	return h.handler.Enabled(ctx, level)
+}
+
+func (h *LevelHandler) Handle(ctx context.Context, r slog.Record) error {
+	// The level of a vmodule rule replaces the default for its files, it may
+	// be lower or higher.
+	if h.state.vmodule.Load() && r.PC != 0 {
+		if site := h.state.site(r.PC); site.ok {
+			if r.Level < site.level {
+				return nil
+			}
+			return h.handler.Handle(ctx, r)
+		}
+	}
+	if r.Level < h.state.level.Level() {
+		return nil
+	}
+	return h.handler.Handle(ctx, r)
+}
+
+func (h *LevelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &LevelHandler{
+		handler: h.handler.WithAttrs(attrs),
+		state:   h.state,
+	}
+}
+
+func (h *LevelHandler) WithGroup(name string) slog.Handler {
+	return &LevelHandler{
+		handler: h.handler.WithGroup(name),
+		state:   h.state,
+	}
+}
+
+func (h *LevelHandler) handlers() []slog.Handler {
+	return []slog.Handler{h.handler}
+}
+
+// Level implements slog.Leveler.
+func (h *LevelHandler) Level() slog.Level {
+	return h.state.level.Level()
+}
+
+// SetLevel atomically changes the default level.
+func (h *LevelHandler) SetLevel(level slog.Level) {
+	h.state.level.Set(level)
+}
+
+// SetVModule replaces the per file levels. The spec is a comma separated list
+// of pattern=level pairs such as "utils/dialer.go=trace,notify/*=debug". A
+// pattern is matched against the trailing segments of the caller's file path
+// with path.Match, a pattern without ".go" selects a whole directory. The
+// first matching pattern wins. An empty spec removes all patterns.
+func (h *LevelHandler) SetVModule(spec string) error {
+	var (
+		patterns []vmodulePattern
+		override = int64(math.MaxInt64)
+	)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		pattern, value, found := strings.Cut(item, "=")
+		pattern = strings.Trim(strings.TrimSpace(pattern), "/")
+		if !found || pattern == "" {
+			return fmt.Errorf("invalid vmodule pattern %q", item)
+		}
+		level, err := ParseLevel(value)
+		if err != nil {
+			return err
+		}
+		if !strings.HasSuffix(pattern, ".go") && !strings.HasSuffix(pattern, "*") {
+			pattern += "/*"
+		}
+		if _, err = path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid vmodule pattern %q: %w", item, err)
+		}
+		patterns = append(patterns, vmodulePattern{
+			pattern:  pattern,
+			segments: strings.Count(pattern, "/") + 1,
+			level:    level,
+		})
+		override = min(override, int64(level))
+	}
+	h.state.mu.Lock()
+	h.state.patterns = patterns
+	h.state.sites.Store(new(sync.Map))
+	h.state.override.Store(override)
+	h.state.vmodule.Store(len(patterns) > 0)
+	h.state.mu.Unlock()
+	return nil
+}
+
+// NewLevelHandler wraps h, which should be enabled for every level that may
+// be selected later, e.g. a TerminalHandler created with LevelTrace.
+func NewLevelHandler(h slog.Handler, level slog.Level) *LevelHandler {
+	state := &levelState{}
+	state.level.Set(level)
+	state.override.Store(math.MaxInt64)
+	state.sites.Store(new(sync.Map))
+	return &LevelHandler{
+		handler: h,
+		state:   state,
+	}
+}
@@ -2,9 +2,10 @@ package log
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
-	"os"
 	"runtime"
+	"strings"
 	"time"
 )
 
@@ -25,6 +26,7 @@ const (
 	LevelInfo  slog.Level = slog.LevelInfo
 	LevelWarn  slog.Level = slog.LevelWarn
 	LevelError slog.Level = slog.LevelError
+	LevelPanic slog.Level = 10
 	LevelFatal slog.Level = 12
 )
 
@@ -64,6 +66,8 @@ func LevelAlignedString(l slog.Level) string {
 		return "WARN "
 	case slog.LevelError:
 		return "ERROR"
+	case LevelPanic:
+		return "PANIC"
 	case LevelFatal:
 		return "FATAL"
 	default:
@@ -83,6 +87,8 @@ func LevelString(l slog.Level) string {
 		return "warn"
 	case slog.LevelError:
 		return "eror"
+	case LevelPanic:
+		return "panic"
 	case LevelFatal:
 		return "crit"
 	default:
@@ -90,6 +96,32 @@ func LevelString(l slog.Level) string {
 	}
 }
 
+// ParseLevel accepts the names returned by LevelString and LevelAlignedString
+// in any case, as well as everything slog.Level.UnmarshalText understands.
+func ParseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "trace":
+		return LevelTrace, nil
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "eror", "error":
+		return slog.LevelError, nil
+	case "panic":
+		return LevelPanic, nil
+	case "crit", "fatal":
+		return LevelFatal, nil
+	}
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q", s)
+	}
+	return l, nil
+}
+
 type Logger interface {
 	With(ctx ...interface{}) Logger
 
@@ -107,10 +139,29 @@ type Logger interface {
 
 	Error(msg string, ctx ...interface{})
 
+	Panic(msg string, ctx ...interface{})
+
 	Fatal(msg string, ctx ...interface{})
 
+	LogCtx(ctx context.Context, level slog.Level, msg string, attrs ...any)
+
+	TraceCtx(ctx context.Context, msg string, attrs ...any)
+
+	DebugCtx(ctx context.Context, msg string, attrs ...any)
+
+	InfoCtx(ctx context.Context, msg string, attrs ...any)
+
+	WarnCtx(ctx context.Context, msg string, attrs ...any)
+
+	ErrorCtx(ctx context.Context, msg string, attrs ...any)
+
+	// Write is meant for logging wrappers: the source location of the record
+	// is the caller of the function that called Write.
 	Write(level slog.Level, msg string, attrs ...any)
 
+	// WriteCtx is Write with a context, which is handed to the handler.
+	WriteCtx(ctx context.Context, level slog.Level, msg string, attrs ...any)
+
 	Enabled(ctx context.Context, level slog.Level) bool
 
 	Handler() slog.Handler
@@ -131,25 +182,42 @@ func (l *logger) Handler() slog.Handler {
 }
 
 func (l *logger) Write(level slog.Level, msg string, attrs ...any) {
-	if !l.inner.Enabled(context.Background(), level) {
+	l.write(context.Background(), level, msg, attrs...)
+}
+
+func (l *logger) WriteCtx(ctx context.Context, level slog.Level, msg string, attrs ...any) {
+	l.write(ctx, level, msg, attrs...)
+}
+
+// write must only be called by Write and WriteCtx, the number of frames it
+// skips depends on it.
+func (l *logger) write(ctx context.Context, level slog.Level, msg string, attrs ...any) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if !l.inner.Enabled(ctx, level) {
 		return
 	}
 
 	var pcs [1]uintptr
-	runtime.Callers(3, pcs[:])
+	runtime.Callers(4, pcs[:])
 
 	if len(attrs)%2 != 0 {
 		attrs = append(attrs, nil, errorKey, "Normalized odd number of arguments by adding nil")
 	}
 	r := slog.NewRecord(time.Now(), level, msg, pcs[0])
 	r.Add(attrs...)
-	l.inner.Handler().Handle(context.Background(), r)
+	l.inner.Handler().Handle(ctx, r)
 }
 
 func (l *logger) Log(level slog.Level, msg string, attrs ...any) {
 	l.Write(level, msg, attrs...)
 }
 
+func (l *logger) LogCtx(ctx context.Context, level slog.Level, msg string, attrs ...any) {
+	l.WriteCtx(ctx, level, msg, attrs...)
+}
+
 func (l *logger) With(ctx ...interface{}) Logger {
 	return &logger{l.inner.With(ctx...)}
 }
@@ -182,7 +250,36 @@ func (l *logger) Error(msg string, ctx ...interface{}) {
 	l.Write(slog.LevelError, msg, ctx...)
 }
 
+func (l *logger) TraceCtx(ctx context.Context, msg string, attrs ...any) {
+	l.WriteCtx(ctx, LevelTrace, msg, attrs...)
+}
+
+func (l *logger) DebugCtx(ctx context.Context, msg string, attrs ...any) {
+	l.WriteCtx(ctx, slog.LevelDebug, msg, attrs...)
+}
+
+func (l *logger) InfoCtx(ctx context.Context, msg string, attrs ...any) {
+	l.WriteCtx(ctx, slog.LevelInfo, msg, attrs...)
+}
+
+func (l *logger) WarnCtx(ctx context.Context, msg string, attrs ...any) {
+	l.WriteCtx(ctx, slog.LevelWarn, msg, attrs...)
+}
+
+func (l *logger) ErrorCtx(ctx context.Context, msg string, attrs ...any) {
+	l.WriteCtx(ctx, slog.LevelError, msg, attrs...)
+}
+
+// Panic logs at LevelPanic, flushes the handlers and panics with msg, so
+// that deferred calls still run and the panic can be recovered.
+func (l *logger) Panic(msg string, ctx ...interface{}) {
+	l.Write(LevelPanic, msg, ctx...)
+	flushBeforeExit(l.Handler())
+	panic(msg)
+}
+
+// Fatal logs at LevelFatal and exits through the exit hooks, see Exit.
 func (l *logger) Fatal(msg string, ctx ...interface{}) {
 	l.Write(LevelFatal, msg, ctx...)
-	os.Exit(1)
+	exit(l.Handler(), 1)
 }
@@ -1,10 +1,30 @@
 package log
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/shuiziliu7788/go-tools/notify"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+	"unicode/utf8"
 )
 
 func TestTrace(t *testing.T) {
@@ -33,3 +53,1117 @@ func TestMetric(t *testing.T) {
 		l.Error("Error", "msg", i)
 	}
 }
+
+func TestJSONHandler(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(NewJSONHandlerWithLevel(&buf, LevelDebug))
+	l.Trace("hidden")
+	l.With("app", "tools").Info("request", "ip", "1.1.1.1", "n", big.NewInt(1000000), "err", errors.New("boom"))
+
+	h := NewJSONHandler(&buf).WithAttrs([]slog.Attr{slog.String("app", "tools")}).WithGroup("http")
+	NewLogger(h).Warn("served", "method", "GET", "resp", slog.GroupValue(slog.Int("code", 200)))
+	NewLogger(h).Warn("empty")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("want 3 lines, have %d: %q", len(lines), buf.String())
+	}
+	want := []string{
+		`"level":"info","msg":"request","app":"tools","ip":"1.1.1.1","n":"1000000","err":"boom"}`,
+		`"level":"warn","msg":"served","app":"tools","http":{"method":"GET","resp":{"code":200}}}`,
+		`"level":"warn","msg":"empty","app":"tools"}`,
+	}
+	for i, line := range lines {
+		var obj map[string]any
+		if err := json.Unmarshal([]byte(line), &obj); err != nil {
+			t.Fatalf("line %d is not valid JSON: %v", i, err)
+		}
+		if !strings.HasSuffix(line, want[i]) {
+			t.Errorf("line %d:\nhave %s\nwant suffix %s", i, line, want[i])
+		}
+	}
+}
+
+func TestTerminalHandlerGroups(t *testing.T) {
+	var buf bytes.Buffer
+	h := NewTerminalHandler(&buf, false).WithAttrs([]slog.Attr{slog.String("app", "tools")}).WithGroup("http")
+	l := NewLogger(h.WithAttrs([]slog.Attr{slog.String("method", "GET")}))
+	l.Info("served", "resp", slog.GroupValue(slog.Int("code", 200), slog.Group("size", "bytes", 512)))
+	slog.New(h).WithGroup("req").Info("nested", "id", 1)
+
+	have := buf.String()
+	for _, want := range []string{
+		"app=tools http.method=GET http.resp.code=200 http.resp.size.bytes=512\n",
+		"app=tools http.req.id=1\n",
+	} {
+		if !strings.Contains(have, want) {
+			t.Errorf("output %q does not contain %q", have, want)
+		}
+	}
+}
+
+func TestRotatingWriter(t *testing.T) {
+	dir := t.TempDir()
+	w := &RotatingWriter{
+		Filename:   filepath.Join(dir, "app.log"),
+		MaxSize:    256,
+		Compress:   true,
+		MaxBackups: 2,
+	}
+	l := NewLogger(NewTerminalHandler(w, false))
+	for i := 0; i < 20; i++ {
+		l.Info("rotating writer test", "i", i)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	backups, err := filepath.Glob(filepath.Join(dir, "app-*.log.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("want 2 compressed backups, have %v", backups)
+	}
+	info, err := os.Stat(w.Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() == 0 || info.Size() > w.MaxSize {
+		t.Fatalf("unexpected size of current file: %d", info.Size())
+	}
+	if _, err := w.Write([]byte("after close\n")); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("write after close returned %v", err)
+	}
+	if err := w.Reopen(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("reopen after close returned %v", err)
+	}
+}
+
+func TestRotateSchedule(t *testing.T) {
+	zone := time.FixedZone("IST", 5*3600+1800)
+	now := time.Date(2024, 3, 1, 10, 45, 0, 0, zone)
+	if next := RotateHourly.next(now); !next.Equal(time.Date(2024, 3, 1, 11, 0, 0, 0, zone)) {
+		t.Errorf("next hour of %v is %v", now, next)
+	}
+	if next := RotateDaily.next(now); !next.Equal(time.Date(2024, 3, 2, 0, 0, 0, 0, zone)) {
+		t.Errorf("next day of %v is %v", now, next)
+	}
+
+	// An empty file is not rotated, but the next period starts anyway.
+	w := &RotatingWriter{Schedule: RotateHourly, nextRotate: now}
+	if w.shouldRotate(10, now) || !w.nextRotate.After(now) {
+		t.Errorf("empty file rotated or schedule not advanced: %v", w.nextRotate)
+	}
+	w.size = 10
+	if w.shouldRotate(10, now.Add(time.Minute)) {
+		t.Error("rotated before the next period")
+	}
+	if !w.shouldRotate(10, now.Add(time.Hour)) {
+		t.Error("not rotated after the next period")
+	}
+}
+
+type slowWriter struct {
+	mu    sync.Mutex
+	lines int
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	w.mu.Lock()
+	w.lines++
+	w.mu.Unlock()
+	return len(p), nil
+}
+
+func TestAsyncHandler(t *testing.T) {
+	for _, policy := range []DropPolicy{Block, DropNewest, DropOldest} {
+		w := new(slowWriter)
+		h := NewAsyncHandler(NewTerminalHandler(w, false), 8, policy)
+		l := NewLogger(h).With("policy", policy)
+		for i := 0; i < 100; i++ {
+			l.Info("async", "i", i)
+		}
+		h.Flush()
+		w.mu.Lock()
+		lines := w.lines
+		w.mu.Unlock()
+		if policy == Block && (lines != 100 || h.Dropped() != 0) {
+			t.Errorf("blocking queue wrote %d lines, dropped %d", lines, h.Dropped())
+		}
+		if policy != Block && (h.Dropped() == 0 || uint64(lines) < 100-h.Dropped()) {
+			t.Errorf("policy %d wrote %d lines, dropped %d", policy, lines, h.Dropped())
+		}
+		h.Close()
+		l.Info("after close")
+	}
+}
+
+// gateHandler blocks in Handle until the gate is closed.
+type gateHandler struct {
+	gate    chan struct{}
+	started chan struct{}
+}
+
+func (h *gateHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *gateHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *gateHandler) WithGroup(string) slog.Handler            { return h }
+
+func (h *gateHandler) Handle(context.Context, slog.Record) error {
+	select {
+	case h.started <- struct{}{}:
+	default:
+	}
+	<-h.gate
+	return nil
+}
+
+func TestAsyncNilContext(t *testing.T) {
+	var buf bytes.Buffer
+	h := NewAsyncHandler(NewJSONHandler(&buf), 4, Block)
+	NewLogger(h).InfoCtx(nil, "no context")
+	slog.New(h).InfoContext(nil, "slog without context")
+	h.Close()
+	if !strings.Contains(buf.String(), `"msg":"no context"`) || !strings.Contains(buf.String(), `"msg":"slog without context"`) {
+		t.Errorf("unexpected output %s", buf.String())
+	}
+}
+
+func TestAsyncDropOldestKeepsFlush(t *testing.T) {
+	inner := &gateHandler{gate: make(chan struct{}), started: make(chan struct{}, 1)}
+	h := NewAsyncHandler(inner, 2, DropOldest)
+	defer h.Close()
+	release := sync.OnceFunc(func() { close(inner.gate) })
+	defer release()
+	l := NewLogger(h)
+	l.Info("a")
+	<-inner.started
+	l.Info("b")
+	flushed := make(chan struct{})
+	go func() {
+		h.Flush()
+		close(flushed)
+	}()
+	for len(h.queue.entries) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	l.Info("c")
+	l.Info("d")
+	select {
+	case <-flushed:
+		t.Fatal("Flush returned while a record before it was still being written")
+	case <-time.After(20 * time.Millisecond):
+	}
+	release()
+	<-flushed
+}
+
+func TestAsyncDropOldestOnlyMarkers(t *testing.T) {
+	inner := &gateHandler{gate: make(chan struct{}), started: make(chan struct{}, 1)}
+	h := NewAsyncHandler(inner, 2, DropOldest)
+	defer h.Close()
+	release := sync.OnceFunc(func() { close(inner.gate) })
+	defer release()
+	l := NewLogger(h)
+	l.Info("a")
+	<-inner.started
+	for i := 0; i < 2; i++ {
+		go h.Flush()
+	}
+	for len(h.queue.entries) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	logged := make(chan struct{})
+	go func() {
+		l.Info("b")
+		close(logged)
+	}()
+	select {
+	case <-logged:
+	case <-time.After(time.Second):
+		t.Fatal("record waited for a queue full of flush markers")
+	}
+	if h.Dropped() != 1 {
+		t.Errorf("dropped %d records, want 1", h.Dropped())
+	}
+}
+
+func TestMultiHandler(t *testing.T) {
+	var terminal, errs, proxy bytes.Buffer
+	h := NewMultiHandler(
+		Sink{Handler: NewTerminalHandler(&terminal, false)},
+		Sink{Handler: NewJSONHandler(&errs), Level: LevelError},
+		Sink{Handler: NewJSONHandler(&proxy), Filter: MatchAttr("svc.proxy", "on")},
+	)
+	l := NewLogger(h.WithGroup("svc")).With("proxy", "on")
+	l.Info("dial")
+	l.Error("dial failed", "ip", "1.1.1.1")
+	NewLogger(h).Error("other")
+
+	if n := strings.Count(terminal.String(), "\n"); n != 3 {
+		t.Errorf("terminal got %d lines, want 3", n)
+	}
+	if n := strings.Count(errs.String(), "\n"); n != 2 {
+		t.Errorf("error sink got %d lines, want 2", n)
+	}
+	if n := strings.Count(proxy.String(), "\n"); n != 2 || !strings.Contains(proxy.String(), `"svc":{"proxy":"on","ip":"1.1.1.1"}`) {
+		t.Errorf("filtered sink got %q", proxy.String())
+	}
+}
+
+func TestLevelHandler(t *testing.T) {
+	var buf bytes.Buffer
+	h := NewLevelHandler(NewTerminalHandler(&buf, false), LevelInfo)
+	l := NewLogger(h)
+	l.Debug("hidden")
+	h.SetLevel(LevelDebug)
+	l.Debug("shown")
+	h.SetLevel(LevelWarn)
+	if err := h.SetVModule("log/logger_test.go=trace,notify/*=debug"); err != nil {
+		t.Fatal(err)
+	}
+	l.Trace("from test file")
+	if err := h.SetVModule("notify=debug"); err != nil {
+		t.Fatal(err)
+	}
+	l.Info("hidden again")
+	h.SetLevel(LevelInfo)
+	if err := h.SetVModule("log/logger_test.go=error"); err != nil {
+		t.Fatal(err)
+	}
+	l.Info("hidden by a stricter rule")
+	l.Error("error from test file")
+
+	have := buf.String()
+	if strings.Contains(have, "hidden") || !strings.Contains(have, "shown") || !strings.Contains(have, "from test file") || !strings.Contains(have, "error from test file") {
+		t.Errorf("unexpected output %q", have)
+	}
+	if err := h.SetVModule("utils/dialer.go"); err == nil {
+		t.Error("expected error for pattern without level")
+	}
+}
+
+func TestSamplingHandler(t *testing.T) {
+	var buf bytes.Buffer
+	h := NewSamplingHandler(NewTerminalHandler(&buf, false), time.Hour, 3, 10)
+	l := NewLogger(h)
+	for i := 0; i < 100; i++ {
+		l.Trace("test dialer failed", "i", i)
+	}
+	l.Info("other")
+	h.Close()
+
+	have := buf.String()
+	if n := strings.Count(have, "test dialer failed"); n != 3+9+1 {
+		t.Errorf("have %d sampled lines, want 13:\n%s", n, have)
+	}
+	if !strings.Contains(have, "suppressed=88") || !strings.Contains(have, "other") {
+		t.Errorf("missing summary or unrelated line:\n%s", have)
+	}
+
+	buf.Reset()
+	h = NewSamplingHandler(NewTerminalHandler(&buf, false), time.Hour, 1, 0)
+	defer h.Close()
+	l = NewLogger(h)
+	for i := 0; i < 5; i++ {
+		l.Info("flushed", "i", i)
+	}
+	if err := FlushHandler(l.Handler()); err != nil {
+		t.Fatal(err)
+	}
+	if have := buf.String(); !strings.Contains(have, "suppressed=4 total=5") {
+		t.Errorf("flush did not write the summary:\n%s", have)
+	}
+}
+
+func TestTerminalHandlerCaller(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(NewTerminalHandlerWithOptions(&buf, TerminalOptions{Caller: CallerShort, CallerFunc: true}))
+	prev := Root()
+	SetDefault(l)
+	defer SetDefault(prev)
+
+	_, _, line, _ := runtime.Caller(0)
+	l.Info("method")
+	Info("package function")
+	l.With("k", "v").Log(LevelInfo, "log")
+
+	want := []string{
+		fmt.Sprintf("] logger_test.go:%d log.TestTerminalHandlerCaller method", line+1),
+		fmt.Sprintf("] logger_test.go:%d log.TestTerminalHandlerCaller package function", line+2),
+		fmt.Sprintf("] logger_test.go:%d log.TestTerminalHandlerCaller log", line+3),
+	}
+	for _, w := range want {
+		if !strings.Contains(buf.String(), w) {
+			t.Errorf("output %q does not contain %q", buf.String(), w)
+		}
+	}
+}
+
+func TestContextLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(NewContextHandler(NewTerminalHandlerWithOptions(&buf, TerminalOptions{Caller: CallerShort})))
+	ctx := WithContext(context.Background(), l.With("svc", "api"))
+	ctx = WithTraceID(WithRequestID(ctx, "r-1"), "t-1")
+
+	_, _, line, _ := runtime.Caller(0)
+	InfoCtx(ctx, "from context")
+	FromContext(ctx).ErrorCtx(ctx, "failed", "ip", "1.1.1.1")
+	if FromContext(context.Background()) != Root() {
+		t.Error("FromContext without logger should return the root logger")
+	}
+	if attrs := ContextAttrs(WithRequestID(nil, "r-2")); len(attrs) != 1 || attrs[0].Value.String() != "r-2" {
+		t.Errorf("unexpected attributes %v from a nil context", attrs)
+	}
+
+	for _, want := range []string{
+		fmt.Sprintf("logger_test.go:%d from context", line+1),
+		"svc=api request_id=r-1 trace_id=t-1\n",
+		fmt.Sprintf("logger_test.go:%d failed", line+2),
+		"svc=api ip=1.1.1.1 request_id=r-1 trace_id=t-1\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("output %q does not contain %q", buf.String(), want)
+		}
+	}
+}
+
+func TestContextHandlerGroup(t *testing.T) {
+	var buf bytes.Buffer
+	l := slog.New(NewContextHandler(NewJSONHandler(&buf))).With("app", "api").WithGroup("db").With("table", "users")
+	l.InfoContext(WithRequestID(context.Background(), "r1"), "query", "n", 1)
+	l.InfoContext(context.Background(), "no request")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected output %s", buf.String())
+	}
+	for i, want := range []string{
+		`"app":"api","request_id":"r1","db":{"table":"users","n":1}}`,
+		`"app":"api","db":{"table":"users"}}`,
+	} {
+		if !strings.HasSuffix(lines[i], want) {
+			t.Errorf("have %s, want suffix %s", lines[i], want)
+		}
+	}
+}
+
+func TestRedactNested(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(NewRedactHandler(NewJSONHandler(&buf), DefaultRedactOptions()))
+	l.Info("send",
+		"emails", []notify.Email{{Host: "smtp.qq.com", Password: "topsecretpw"}},
+		"nested", map[string]any{"list": []any{map[string]any{"token": "tk_nestedsecret"}}},
+		"ids", []int{1, 2},
+	)
+
+	have := buf.String()
+	for _, secret := range []string{"topsecretpw", "tk_nestedsecret"} {
+		if strings.Contains(have, secret) {
+			t.Errorf("secret %q leaked: %s", secret, have)
+		}
+	}
+	for _, want := range []string{`"password":"******"`, `"token":"******"`, `"ids":[1,2]`} {
+		if !strings.Contains(have, want) {
+			t.Errorf("output %s does not contain %s", have, want)
+		}
+	}
+}
+
+func TestRedactHandler(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(NewRedactHandler(NewJSONHandler(&buf), DefaultRedactOptions()))
+	l.With("password", "p@ss").Info("send",
+		"email", &notify.Email{Host: "smtp.qq.com", Password: "euypgokzavkseceh"},
+		"pusher", notify.WxPusher{AppToken: "AT_dWk1PSaCmPieZ8MkuY7KqsOHxuwARB3t"},
+		"url", "https://api.telegram.org/bot7977501962:AAGqU5uEsTJZqvNWTWt-9EBrmlRv5CwpvQM/send",
+		"card", "6222 0202 0000 1234",
+		"auth", slog.GroupValue(slog.String("Api-Key", "k"), slog.Int("n", 1)),
+		"plain", struct{ Name string }{"x"},
+	)
+
+	have := buf.String()
+	for _, secret := range []string{"p@ss", "euypgokzavkseceh", "AT_dWk1P", "AAGqU5uE", "6222"} {
+		if strings.Contains(have, secret) {
+			t.Errorf("secret %q leaked: %s", secret, have)
+		}
+	}
+	for _, want := range []string{
+		`"password":"******"`,
+		`"email":{"host":"smtp.qq.com","port":0,"username":"","password":"******","recipient":null}`,
+		`"pusher":{"app_token":"******"`,
+		`"url":"https://api.telegram.org/bot******/send"`,
+		`"auth":{"Api-Key":"******","n":1}`,
+		`"plain":{"Name":"x"}`,
+	} {
+		if !strings.Contains(have, want) {
+			t.Errorf("output %s does not contain %s", have, want)
+		}
+	}
+}
+
+func TestRingHandler(t *testing.T) {
+	h := NewRingHandler(5, LevelDebug)
+	l := NewLogger(h).With("svc", "proxy")
+	for i := 0; i < 8; i++ {
+		l.Info("dial", "i", i)
+	}
+	l.Error("dial failed", "ip", "1.1.1.1")
+	l.Trace("hidden")
+
+	if records := h.Records(RingQuery{}); len(records) != 5 || records[0].Message != "dial" || records[4].Message != "dial failed" {
+		t.Fatalf("unexpected records %v", records)
+	}
+	if records := h.Records(RingQuery{MinLevel: LevelError, Attrs: map[string]any{"ip": "1.1.1.1", "svc": "proxy"}}); len(records) != 1 {
+		t.Errorf("want 1 error record, have %d", len(records))
+	}
+	if records := h.Records(RingQuery{Message: "dial", MaxLevel: LevelInfo, Limit: 2}); len(records) != 2 || !hasAttr(records[1], "i", "7") {
+		t.Errorf("unexpected limited records %v", records)
+	}
+	if records := h.Records(RingQuery{Since: time.Now().Add(time.Minute)}); len(records) != 0 {
+		t.Errorf("want no records from the future, have %d", len(records))
+	}
+
+	var buf bytes.Buffer
+	if err := h.DumpJSON(&buf, RingQuery{MinLevel: LevelError}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"msg":"dial failed","svc":"proxy","ip":"1.1.1.1"}`) {
+		t.Errorf("unexpected dump %s", buf.String())
+	}
+}
+
+func TestTerminalHandlerOptions(t *testing.T) {
+	var buf bytes.Buffer
+	theme := &ColorTheme{Levels: map[slog.Level]string{LevelInfo: "<info>"}, Key: "<key>"}
+	h := NewTerminalHandlerWithOptions(&buf, TerminalOptions{
+		Color:      ColorAlways,
+		Theme:      theme,
+		TimeFormat: time.RFC3339,
+		Location:   time.UTC,
+	})
+	r := slog.NewRecord(time.Date(2024, 5, 1, 8, 0, 0, 0, time.FixedZone("CST", 8*3600)), LevelInfo, "themed", 0)
+	r.AddAttrs(slog.Int("n", 1))
+	h.Handle(context.Background(), r)
+	want := "<info>INFO \x1b[0m[2024-05-01T00:00:00Z] themed                                   <key>n\x1b[0m=1\n"
+	if buf.String() != want {
+		t.Errorf("have %q\nwant %q", buf.String(), want)
+	}
+
+	if NewTerminalHandler(&buf, true).useColor {
+		t.Error("colors enabled for a non-terminal writer")
+	}
+	t.Setenv("NO_COLOR", "1")
+	if UseColor(os.Stdout) {
+		t.Error("colors enabled although NO_COLOR is set")
+	}
+}
+
+func TestPrometheusHandler(t *testing.T) {
+	rule := &Metric{Name: "dial", Level: LevelError, EvaluatePeriod: time.Minute, Threshold: 100}
+	alerts := NewMetricHandler(NewTerminalHandler(io.Discard, false), rule)
+	h := NewPrometheusHandler(alerts, PrometheusOptions{
+		Level:     LevelDebug,
+		Message:   true,
+		Labels:    []string{"http.method", "level"},
+		MaxSeries: 3,
+		Alerts:    alerts,
+	})
+	l := NewLogger(h)
+	l.Trace("not counted")
+	l.Debug("request", "http", slog.GroupValue(slog.String("method", "GET")))
+	l.With("http", slog.GroupValue(slog.String("method", "GET"))).Debug("request")
+	l.Error("dial \"failed\"", "level", 3)
+	l.Info("started")
+	l.Info("overflow")
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %q", resp.Header.Get("Content-Type"))
+	}
+	for _, want := range []string{
+		"# TYPE log_records_total counter\n",
+		`log_records_total{level="debug",msg="request",http_method="GET",attr_level=""} 2` + "\n",
+		`log_records_total{level="eror",msg="dial \"failed\"",http_method="",attr_level="3"} 1` + "\n",
+		`log_records_total{level="info",msg="started",http_method="",attr_level=""} 1` + "\n",
+		"log_records_overflow_total 1\n",
+		`log_alert_state{name="dial",state="inactive"} 1` + "\n",
+		`log_alert_state{name="dial",state="firing"} 0` + "\n",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("exposition lacks %q:\n%s", want, body)
+		}
+	}
+	if strings.Contains(string(body), `level="trace"`) {
+		t.Errorf("trace record was counted:\n%s", body)
+	}
+
+	h = NewPrometheusHandler(NewTerminalHandler(io.Discard, false), PrometheusOptions{
+		Labels: []string{"http.method", "http_method", "__name__", ""},
+	})
+	NewLogger(h).Info("collide", "http", slog.GroupValue(slog.String("method", "GET")), "http_method", "POST", "__name__", "x")
+	var out strings.Builder
+	h.WriteTo(&out)
+	want := `log_records_total{level="info",http_method="GET",http_method_2="POST",attr___name__="x",attr_=""} 1`
+	if !strings.Contains(out.String(), want) {
+		t.Errorf("exposition lacks %q:\n%s", want, out.String())
+	}
+}
+
+func TestFatalExit(t *testing.T) {
+	var code int
+	osExit = func(c int) { code = c }
+	defer func() { osExit = os.Exit }()
+
+	buf := &bytes.Buffer{}
+	async := NewAsyncHandler(NewJSONHandler(buf), 16, Block)
+	defer async.Close()
+	l := NewLogger(NewLevelHandler(async, LevelInfo))
+
+	var order []string
+	RegisterExitHook(func() { order = append(order, "first") })
+	RegisterExitHook(func() {
+		order = append(order, "second")
+		l.Info("cleanup")
+	})
+	RegisterExitHook(func() { panic("broken hook") })
+	l.Fatal("giving up", "reason", "test")
+
+	if code != 1 {
+		t.Errorf("have exit code %d, want 1", code)
+	}
+	if strings.Join(order, ",") != "second,first" {
+		t.Errorf("hooks ran in order %v", order)
+	}
+	out := buf.String()
+	if !strings.Contains(out, `"msg":"giving up"`) || !strings.Contains(out, `"msg":"cleanup"`) {
+		t.Errorf("records were not flushed before exit:\n%s", out)
+	}
+
+	timeout := ExitTimeout
+	ExitTimeout = 200 * time.Millisecond
+	defer func() { ExitTimeout = timeout }()
+	release := make(chan struct{})
+	defer close(release)
+	RegisterExitHook(func() { <-release })
+	start := time.Now()
+	l.Info("before exit")
+	exit(l.Handler(), 2)
+	if code != 2 || time.Since(start) > 2*time.Second {
+		t.Errorf("have exit code %d after %s, want 2 after the timeout", code, time.Since(start))
+	}
+	if !strings.Contains(buf.String(), `"msg":"before exit"`) {
+		t.Errorf("a stuck hook held up the flush:\n%s", buf.String())
+	}
+}
+
+func TestPanic(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := NewLogger(NewJSONHandler(buf))
+	defer func() {
+		if r := recover(); r != "bad state" {
+			t.Errorf("recovered %v", r)
+		}
+		if !strings.Contains(buf.String(), `"level":"panic","msg":"bad state"`) {
+			t.Errorf("unexpected output %s", buf.String())
+		}
+	}()
+	l.Panic("bad state", "id", 1)
+}
+
+// stuckFlusher is a handler whose Flush never returns.
+type stuckFlusher struct {
+	slog.Handler
+}
+
+func (stuckFlusher) Flush() error {
+	select {}
+}
+
+func TestPanicFlushTimeout(t *testing.T) {
+	timeout := ExitTimeout
+	ExitTimeout = 10 * time.Millisecond
+	defer func() { ExitTimeout = timeout }()
+	l := NewLogger(stuckFlusher{NewJSONHandler(io.Discard)})
+	start := time.Now()
+	defer func() {
+		if r := recover(); r != "stuck" {
+			t.Errorf("recovered %v", r)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("Panic waited %s for the flush", elapsed)
+		}
+	}()
+	l.Panic("stuck")
+}
+
+func TestStackAndErrors(t *testing.T) {
+	errPerm := errors.New("permission denied")
+	err := errors.Join(
+		fmt.Errorf("read config: %w", fmt.Errorf("open app.toml: %w", errPerm)),
+		errors.New("connection refused"),
+	)
+
+	buf := &bytes.Buffer{}
+	l := NewLogger(NewStackHandler(NewTerminalHandler(buf, false), LevelError))
+	l.Warn("retrying", "err", fmt.Errorf("dial: %w", errPerm))
+	l.Error("startup failed", "err", err)
+	out := buf.String()
+	for _, want := range []string{
+		"\n  err: dial: permission denied\n    caused by: permission denied\n",
+		"  err: 2 errors\n    [0] read config: open app.toml: permission denied\n      caused by: open app.toml: permission denied\n      caused by: permission denied\n    [1] connection refused\n",
+		"  stack:\n    log.TestStackAndErrors\n        ",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lacks %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "err=") {
+		t.Errorf("wrapped error written in the line as well:\n%s", out)
+	}
+	if strings.Count(out, "stack:") != 1 || strings.Contains(out, "stack=") {
+		t.Errorf("want one stack below the error record:\n%s", out)
+	}
+
+	buf.Reset()
+	l = NewLogger(NewStackHandler(NewJSONHandler(buf), LevelError))
+	l.Error("startup failed", "err", err, "plain", errPerm)
+	var record struct {
+		Err      string `json:"err"`
+		ErrChain []any  `json:"err_chain"`
+		Plain    string
+		Stack    []struct {
+			Func string
+			Line int
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("%v: %s", err, buf.String())
+	}
+	want := `[[read config: open app.toml: permission denied open app.toml: permission denied permission denied] connection refused]`
+	if record.Err != err.Error() || fmt.Sprint(record.ErrChain) != want || record.Plain != "permission denied" {
+		t.Errorf("unexpected errors %q %v %q", record.Err, record.ErrChain, record.Plain)
+	}
+	if strings.Contains(buf.String(), "plain_chain") {
+		t.Errorf("plain error has a chain: %s", buf.String())
+	}
+	if len(record.Stack) == 0 || !strings.HasSuffix(record.Stack[0].Func, "log.TestStackAndErrors") {
+		t.Errorf("stack does not start at the caller: %+v", record.Stack)
+	}
+}
+
+type testUser struct {
+	Name     string
+	Password string
+}
+
+func (u testUser) LogValue() slog.Value {
+	return slog.GroupValue(slog.String("name", u.Name))
+}
+
+type testToken string
+
+func (t testToken) LogValue() slog.Value {
+	return slog.StringValue("***")
+}
+
+func TestLogValuer(t *testing.T) {
+	if have := string(FormatSlogValue(slog.AnyValue(testToken("secret")), nil)); have != "***" {
+		t.Errorf("have %q, want the LogValue", have)
+	}
+	group := slog.GroupValue(slog.Int("a", 1), slog.Any("b", slog.GroupValue(slog.String("c", "x y"))))
+	if have := string(FormatSlogValue(group, nil)); have != `{a=1 b={c="x y"}}` {
+		t.Errorf("unexpected group %s", have)
+	}
+
+	buf := &bytes.Buffer{}
+	l := NewLogger(NewTerminalHandlerWithLevel(buf, LevelInfo, false))
+	l.Info("login", "user", testUser{Name: "bob", Password: "hunter2"}, "token", testToken("secret"))
+	if out := buf.String(); !strings.Contains(out, "user.name=bob") || !strings.Contains(out, "token=***") || strings.Contains(out, "hunter2") {
+		t.Errorf("unexpected output %s", out)
+	}
+
+	buf.Reset()
+	l = NewLogger(NewJSONHandler(buf))
+	l.Info("login", "user", testUser{Name: "bob", Password: "hunter2"})
+	if out := buf.String(); !strings.Contains(out, `"user":{"name":"bob"}`) {
+		t.Errorf("unexpected output %s", out)
+	}
+
+	calls := 0
+	lazy := Lazy(func() any {
+		calls++
+		return "payload"
+	})
+	buf.Reset()
+	l = NewLogger(NewTerminalHandlerWithLevel(buf, LevelInfo, false))
+	l.Debug("dump", "body", lazy)
+	if calls != 0 {
+		t.Errorf("lazy value of a disabled level was evaluated %d times", calls)
+	}
+	l.Info("dump", "body", lazy)
+	if calls != 1 || !strings.Contains(buf.String(), "body=payload") {
+		t.Errorf("have %d calls and output %s", calls, buf.String())
+	}
+}
+
+func TestSyslogHandler(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	facility := FacilityLocal0
+	h := NewSyslogHandler(SyslogOptions{
+		Network:  "udp",
+		Addr:     pc.LocalAddr().String(),
+		Facility: &facility,
+		AppName:  "app",
+		Hostname: "host",
+		Level:    LevelTrace,
+	})
+	defer h.Close()
+	l := NewLogger(h).With("req", `a "b"`)
+	l.Error("failed", "http", slog.GroupValue(slog.String("method", "GET")))
+	l.Trace("tracing")
+
+	buf := make([]byte, 1024)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, want := range []string{
+		`<131>1 \S+ host app \d+ - \[attrs@32473 req="a \\"b\\"" http.method="GET"\] failed$`,
+		`<135>1 \S+ host app \d+ - \[attrs@32473 req="a \\"b\\""\] tracing$`,
+	} {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !regexp.MustCompile(want).Match(buf[:n]) {
+			t.Errorf("have %q, want %s", buf[:n], want)
+		}
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	h = NewSyslogHandler(SyslogOptions{Network: "tcp", Addr: ln.Addr().String(), Hostname: "host", AppName: "app"})
+	defer h.Close()
+	l = NewLogger(h)
+	l.Warn("first")
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	var size int
+	if _, err := fmt.Fscanf(r, "%d ", &size); err != nil {
+		t.Fatal(err)
+	}
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(r, frame); err != nil || !bytes.HasPrefix(frame, []byte("<12>1 ")) || !bytes.HasSuffix(frame, []byte(" - - first")) {
+		t.Fatalf("have frame %q, %v", frame, err)
+	}
+
+	// The server goes away, the handler reconnects.
+	conn.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		l.Warn("again")
+		select {
+		case conn := <-accepted:
+			conn.Close()
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("handler did not reconnect")
+		}
+	}
+}
+
+func TestSyslogHandlerDatagramSize(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	h := NewSyslogHandler(SyslogOptions{Network: "udp", Addr: pc.LocalAddr().String(), Format: RFC3164, Hostname: "host", AppName: "app", MaxSize: 64})
+	defer h.Close()
+	NewLogger(h).Error(strings.Repeat("é", 100))
+
+	buf := make([]byte, 1024)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 || n > 64 || !utf8.Valid(buf[:n]) || !bytes.HasPrefix(buf[:n], []byte("<11>")) {
+		t.Errorf("have datagram %q", buf[:n])
+	}
+}
+
+func TestSyslogHandlerBackoff(t *testing.T) {
+	addr := filepath.Join(t.TempDir(), "log.sock")
+	h := NewSyslogHandler(SyslogOptions{Network: "unixgram", Addr: addr, Format: RFC3164, Hostname: "host", AppName: "app"})
+	defer h.Close()
+	if err := h.write([]byte("down")); err == nil {
+		t.Fatal("write without a server succeeded")
+	}
+	pc, err := net.ListenPacket("unixgram", addr)
+	if err != nil {
+		t.Skip("unix sockets not supported:", err)
+	}
+	defer pc.Close()
+	// The server is back, but the handler waits for the backoff.
+	if err := h.write([]byte("backoff")); err == nil {
+		t.Fatal("write during the backoff dialed again")
+	}
+	time.Sleep(2 * syslogMinBackoff)
+	if err := h.write([]byte("up")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "up" {
+		t.Errorf("have %q, %v", buf[:n], err)
+	}
+}
+
+func TestSyslogHandler3164Stream(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	facility := FacilityKern
+	h := NewSyslogHandler(SyslogOptions{Network: "tcp", Addr: ln.Addr().String(), Format: RFC3164, Facility: &facility, Hostname: "host", AppName: "app"})
+	defer h.Close()
+	NewLogger(h).Error("line one\nline two", "k", "v")
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `^<3>.* host app\[\d+\]: "line one\\nline two" k=v\n$`
+	if !regexp.MustCompile(want).MatchString(line) {
+		t.Errorf("have %q, want %s", line, want)
+	}
+}
+
+func TestSyslogHandlerUnix(t *testing.T) {
+	addr := filepath.Join(t.TempDir(), "log.sock")
+	pc, err := net.ListenPacket("unixgram", addr)
+	if err != nil {
+		t.Skip("unix sockets not supported:", err)
+	}
+	defer pc.Close()
+	h := NewSyslogHandler(SyslogOptions{Network: "unixgram", Addr: addr, Format: RFC3164, Hostname: "host", AppName: "app"})
+	defer h.Close()
+	NewLogger(h).Log(LevelFatal, "shutting down", "code", 1)
+
+	buf := make([]byte, 1024)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `^<10>[A-Z][a-z]{2} [ \d]\d \d\d:\d\d:\d\d host app\[\d+\]: shutting down code=1$`
+	if !regexp.MustCompile(want).Match(buf[:n]) {
+		t.Errorf("have %q, want %s", buf[:n], want)
+	}
+}
+
+func TestShipperHandler(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		bodies []string
+		down   = true
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			body = zr
+		}
+		data, _ := io.ReadAll(body)
+		bodies = append(bodies, r.Header.Get("Content-Type")+"\n"+string(data))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	spool := t.TempDir()
+	h := NewShipperHandler(ShipperOptions{
+		URL:      srv.URL,
+		Format:   ShipLoki,
+		Client:   srv.Client(),
+		Labels:   map[string]string{"app": "api"},
+		Gzip:     true,
+		Interval: time.Hour,
+		Retries:  1,
+		Backoff:  time.Millisecond,
+		SpoolDir: spool,
+	})
+	l := NewLogger(h).With("req", 7)
+	l.Info("first")
+	l.Error("second", "err", errors.New("boom"))
+	h.Flush()
+	if stats := h.Stats(); stats.Spooled != 1 || stats.Sent != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	mu.Lock()
+	down = false
+	mu.Unlock()
+	l.Info("third")
+	h.Close()
+	if stats := h.Stats(); stats.Sent != 2 || stats.Failed != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if files, _ := os.ReadDir(spool); len(files) != 0 {
+		t.Errorf("spool was not emptied: %v", files)
+	}
+	if len(bodies) != 2 {
+		t.Fatalf("have %d requests, want 2", len(bodies))
+	}
+	var push struct {
+		Streams []struct {
+			Stream map[string]string
+			Values [][2]string
+		}
+	}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(bodies[0], "application/json\n")), &push); err != nil {
+		t.Fatalf("%v: %s", err, bodies[0])
+	}
+	if len(push.Streams) != 2 || push.Streams[0].Stream["app"] != "api" || push.Streams[1].Stream["level"] != "eror" {
+		t.Fatalf("unexpected streams %+v", push.Streams)
+	}
+	if line := push.Streams[1].Values[0][1]; !strings.Contains(line, `"msg":"second","req":7,"err":"boom"`) {
+		t.Errorf("unexpected line %s", line)
+	}
+	if !strings.Contains(bodies[1], `\"msg\":\"third\"`) {
+		t.Errorf("unexpected request %s", bodies[1])
+	}
+
+	bodies = nil
+	h = NewShipperHandler(ShipperOptions{URL: srv.URL, Format: ShipElasticsearch, Index: "app-logs", BatchSize: 2, Interval: time.Hour})
+	NewLogger(h).Warn("a")
+	NewLogger(h).Warn("b")
+	NewLogger(h).Warn("c")
+	h.Close()
+	if len(bodies) != 2 || !strings.HasPrefix(bodies[0], "application/x-ndjson\n{\"index\":{\"_index\":\"app-logs\"}}\n{\"time\":") || strings.Count(bodies[0], "\n") != 5 {
+		t.Errorf("unexpected bulk requests %q", bodies)
+	}
+}
+
+func TestShipperBulkErrors(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		requests = append(requests, string(data))
+		first := len(requests) == 1
+		mu.Unlock()
+		if !first {
+			w.Write([]byte(`{"errors":false,"items":[{"index":{"status":201}}]}`))
+			return
+		}
+		w.Write([]byte(`{"errors":true,"items":[` +
+			`{"index":{"status":201}},` +
+			`{"index":{"status":429,"error":{"type":"es_rejected_execution_exception"}}},` +
+			`{"index":{"status":400,"error":{"type":"mapper_parsing_exception"}}}]}`))
+	}))
+	defer srv.Close()
+
+	h := NewShipperHandler(ShipperOptions{URL: srv.URL, Format: ShipElasticsearch, Interval: time.Hour, Backoff: time.Millisecond})
+	l := NewLogger(h)
+	l.Info("a")
+	l.Info("b")
+	l.Info("c")
+	h.Flush()
+	defer h.Close()
+	if stats := h.Stats(); stats.Sent != 1 || stats.Failed != 0 || stats.Rejected != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if len(requests) != 2 || strings.Count(requests[1], "\n") != 2 || !strings.Contains(requests[1], `"msg":"b"`) {
+		t.Errorf("unexpected requests %q", requests)
+	}
+}
+
+func TestShipperLokiLevelLabel(t *testing.T) {
+	s := &shipper{opts: &ShipperOptions{Labels: map[string]string{"app": "api", "level": "x"}}}
+	have := string(s.encodeLoki([]shipEntry{{level: slog.LevelWarn, line: []byte("{}")}}))
+	if !strings.Contains(have, `"stream":{"app":"api","level":"warn"}`) {
+		t.Errorf("unexpected push %s", have)
+	}
+}
+
+func TestShipperCloseDuringBackoff(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	h := NewShipperHandler(ShipperOptions{URL: srv.URL, Interval: time.Hour, BatchSize: 1, Backoff: time.Hour})
+	NewLogger(h).Info("a")
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	h.Close()
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Close waited %v for the backoff", elapsed)
+	}
+	if stats := h.Stats(); stats.Failed != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+// TestCrossCompile builds the package for targets whose terminal detection
+// and signal handling differ from the host.
+// TestCrossCompile builds the package for the platforms with build tags of
+// their own, it runs only with LOG_CROSS_COMPILE=1 set.
+func TestCrossCompile(t *testing.T) {
+	if os.Getenv("LOG_CROSS_COMPILE") != "1" {
+		t.Skip("set LOG_CROSS_COMPILE=1 to cross compile")
+	}
+	for _, target := range []string{"aix/ppc64", "solaris/amd64", "illumos/amd64", "darwin/arm64", "freebsd/amd64", "windows/amd64", "plan9/amd64", "js/wasm", "wasip1/wasm"} {
+		goos, goarch, _ := strings.Cut(target, "/")
+		cmd := exec.Command("go", "build", ".")
+		cmd.Env = append(os.Environ(), "GOOS="+goos, "GOARCH="+goarch, "CGO_ENABLED=0")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Errorf("%s: %v\n%s", target, err, out)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// Package logtest captures the records logged during a test so they can be
+// asserted on, and forwards them to testing.T.Log.
+package logtest
+
+import (
+	"fmt"
+	"github.com/shuiziliu7788/go-tools/log"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// DefaultCapacity is the number of records a Recorder keeps.
+var DefaultCapacity = 10000
+
+// testWriter writes through testing.TB.Log, so the output is only shown for
+// failed tests or with -v.
+type testWriter struct {
+	mu   sync.Mutex
+	t    testing.TB
+	done bool
+}
+
+func (w *testWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.done {
+		// Logging after the test has finished makes testing panic.
+		w.t.Log(strings.TrimSuffix(string(p), "\n"))
+	}
+	return len(p), nil
+}
+
+func (w *testWriter) close() {
+	w.mu.Lock()
+	w.done = true
+	w.mu.Unlock()
+}
+
+// NewTestHandler returns a handler writing records in the terminal format
+// through t.Log.
+func NewTestHandler(t testing.TB) slog.Handler {
+	w := &testWriter{t: t}
+	t.Cleanup(w.close)
+	return log.NewTerminalHandler(w, false)
+}
+
+// SetDefault makes l the root logger until the test ends, then restores the
+// previous one.
+func SetDefault(t testing.TB, l log.Logger) {
+	prev := log.Root()
+	log.SetDefault(l)
+	t.Cleanup(func() {
+		log.SetDefault(prev)
+	})
+}
+
+// Recorder keeps the records logged through its handler.
+type Recorder struct {
+	t       testing.TB
+	ring    *log.RingHandler
+	handler slog.Handler
+}
+
+// New returns a Recorder capturing every level. The records are also written
+// to t.Log.
+func New(t testing.TB) *Recorder {
+	ring := log.NewRingHandler(DefaultCapacity, log.LevelTrace)
+	return &Recorder{
+		t:    t,
+		ring: ring,
+		handler: log.NewMultiHandler(
+			log.Sink{Handler: ring},
+			log.Sink{Handler: NewTestHandler(t)},
+		),
+	}
+}
+
+// Capture returns a Recorder installed as the root logger for the duration of
+// the test, so records of the package level functions are captured too.
+func Capture(t testing.TB) *Recorder {
+	r := New(t)
+	SetDefault(t, r.Logger())
+	return r
+}
+
+func (r *Recorder) Handler() slog.Handler {
+	return r.handler
+}
+
+func (r *Recorder) Logger() log.Logger {
+	return log.NewLogger(r.handler)
+}
+
+// Records returns the captured records, oldest first. Attributes added with
+// Logger.With are included, keys inside groups look like http.method.
+func (r *Recorder) Records() []slog.Record {
+	return r.ring.Records(log.RingQuery{})
+}
+
+// Find returns the records at level whose message contains msg and that have
+// all of the given key/value pairs, compared with fmt.Sprint.
+func (r *Recorder) Find(level slog.Level, msg string, attrs ...any) []slog.Record {
+	q := log.RingQuery{
+		MinLevel: level,
+		MaxLevel: level,
+		Message:  msg,
+		Attrs:    make(map[string]any),
+	}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		q.Attrs[fmt.Sprint(attrs[i])] = attrs[i+1]
+	}
+	return r.ring.Records(q)
+}
+
+// AssertLogged fails the test unless a record matching Find was captured.
+func (r *Recorder) AssertLogged(level slog.Level, msg string, attrs ...any) {
+	r.t.Helper()
+	if len(r.Find(level, msg, attrs...)) == 0 {
+		r.t.Errorf("no %s record %q with %v was logged", log.LevelString(level), msg, attrs)
+	}
+}
+
+// AssertNotLogged fails the test if a record matching Find was captured.
+func (r *Recorder) AssertNotLogged(level slog.Level, msg string, attrs ...any) {
+	r.t.Helper()
+	if found := r.Find(level, msg, attrs...); len(found) > 0 {
+		r.t.Errorf("unexpected %s record %q with %v was logged %d times", log.LevelString(level), msg, attrs, len(found))
+	}
+}
+
+// Reset drops the captured records.
+func (r *Recorder) Reset() {
+	r.ring.Reset()
+}
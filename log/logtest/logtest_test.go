@@ -0,0 +1,37 @@
+package logtest
+
+import (
+	"errors"
+	"github.com/shuiziliu7788/go-tools/log"
+	"testing"
+)
+
+func TestCapture(t *testing.T) {
+	rec := Capture(t)
+	log.Info("dial", "ip", "1.1.1.1")
+	log.New("svc", "proxy").Error("dial failed", "ip", "1.1.1.2", "err", errors.New("timeout"))
+
+	rec.AssertLogged(log.LevelError, "dial failed", "ip", "1.1.1.2", "svc", "proxy", "err", "timeout")
+	rec.AssertLogged(log.LevelInfo, "dial")
+	rec.AssertNotLogged(log.LevelError, "dial failed", "ip", "1.1.1.1")
+	if n := len(rec.Records()); n != 2 {
+		t.Errorf("have %d records, want 2", n)
+	}
+	rec.Reset()
+	if n := len(rec.Records()); n != 0 {
+		t.Errorf("have %d records after reset, want 0", n)
+	}
+}
+
+func TestSetDefault(t *testing.T) {
+	prev := log.Root()
+	t.Run("scoped", func(t *testing.T) {
+		SetDefault(t, New(t).Logger())
+		if log.Root() == prev {
+			t.Error("root logger was not replaced")
+		}
+	})
+	if log.Root() != prev {
+		t.Error("root logger was not restored")
+	}
+}
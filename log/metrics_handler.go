@@ -2,9 +2,12 @@ package log
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"html/template"
 	"log/slog"
+	"os"
+	"regexp"
 	"sort"
 	"strings"
 	"sync"
@@ -44,80 +47,457 @@ type Notify interface {
 	Send(title string, content string)
 }
 
+// AttrMatcher matches a record attribute by key and by the fmt.Sprint form of
+// its value. Keys inside groups are written as http.method.
+type AttrMatcher struct {
+	Key     string `json:"key"`
+	Value   string `json:"value,omitempty"`   // 与属性值完全相同
+	Pattern string `json:"pattern,omitempty"` // 属性值需要匹配的正则表达式
+	re      *regexp.Regexp
+}
+
+func (a *AttrMatcher) match(r *slog.Record) bool {
+	found := false
+	r.Attrs(func(attr slog.Attr) bool {
+		if attr.Key != a.Key {
+			return true
+		}
+		value := attr.Value.String()
+		found = (a.Value == "" || value == a.Value) && (a.re == nil || a.re.MatchString(value))
+		return !found
+	})
+	return found
+}
+
+// AlertState is the state of the alert of a Metric.
+type AlertState int
+
+const (
+	AlertInactive AlertState = iota
+	AlertPending             // 已超过阈值，等待 For 时间
+	AlertFiring              // 已触发
+	AlertResolved            // 已恢复
+)
+
+func (s AlertState) String() string {
+	switch s {
+	case AlertPending:
+		return "pending"
+	case AlertFiring:
+		return "firing"
+	case AlertResolved:
+		return "resolved"
+	default:
+		return "inactive"
+	}
+}
+
+// Metric is an alert rule: once Threshold matching records were logged within
+// EvaluatePeriod for at least For, the alert fires and Notify is sent a
+// message, repeated at most once per NotifyPeriod while it keeps firing. When
+// the count drops below Threshold a resolved message follows.
 type Metric struct {
 	Notify         Notify
+	Dispatcher     *Dispatcher   `json:"-"` // 为空时使用 DefaultDispatcher
+	Store          AlertStore    `json:"-"` // 保存告警状态，重启后不会重复通知
 	Name           string        `json:"name"`
-	Level          slog.Level    `json:"level"`
-	NotifyPeriod   time.Duration `json:"notify_period"`   // 30分钟内最多通知一次
-	EvaluatePeriod time.Duration `json:"evaluate_period"` // 5分钟内统计日志
-	Threshold      int           `json:"threshold"`       // 触发通知的日志数量阈值
+	Level          slog.Level    `json:"level"`               // 统计的最低日志级别，零值为 ERROR
+	MinLevel       *slog.Level   `json:"min_level,omitempty"` // 非空时代替 Level，可以设为 INFO
+	MaxLevel       *slog.Level   `json:"max_level,omitempty"` // 统计的最高日志级别，为空时不限制
+	Message        string        `json:"message,omitempty"`   // 日志消息需要匹配的正则表达式
+	Attrs          []AttrMatcher `json:"attrs,omitempty"`     // 日志需要包含的属性
+	NotifyPeriod   time.Duration `json:"notify_period"`       // 30分钟内最多通知一次
+	EvaluatePeriod time.Duration `json:"evaluate_period"`     // 5分钟内统计日志
+	Threshold      int           `json:"threshold"`           // 触发通知的日志数量阈值
+	For            time.Duration `json:"for,omitempty"`       // 超过阈值持续多久后才触发
+	GroupBy        []string      `json:"group_by,omitempty"`  // 除消息外用于合并日志的属性
+	MaxGroups      int           `json:"max_groups"`          // 通知中最多显示的分组数，默认 10
+	GroupExamples  int           `json:"group_examples"`      // 每个分组显示的日志条数，默认 1
+
+	Templates     map[string]AlertTemplate `json:"-"`                        // 按格式使用的模板，为空时使用 DefaultTemplates
+	TemplateFiles map[string]string        `json:"template_files,omitempty"` // 按格式从文件加载的模板
+
 	lastNotify     time.Time
 	nextNotifyTime time.Time
 	records        []*slog.Record
+	state          AlertState
+	pendingSince   time.Time
+	firingSince    time.Time
+	peak           int
+	restoreOnce    sync.Once
+	restoredAt     time.Time
+	saveMu         sync.Mutex
+	saveNext       *AlertSnapshot // 等待保存的最新状态
+	saveDone       chan struct{}  // 非空时有 goroutine 在保存
 	mu             sync.Mutex
+	compileOnce    sync.Once
+	compileErr     error
+	messageRe      *regexp.Regexp
 }
 
-func (m *Metric) sendNotification() {
-	m.lastNotify = time.Now()
-	next := m.lastNotify.Add(m.NotifyPeriod)
-	m.lastNotify = next
+// Validate compiles the regular expressions and loads the TemplateFiles of the
+// rule. A rule that does not compile never matches, NewMetricHandlers rejects
+// it.
+func (m *Metric) Validate() error {
+	m.compileOnce.Do(func() {
+		for format, filename := range m.TemplateFiles {
+			var tmpl AlertTemplate
+			if tmpl, m.compileErr = ParseAlertTemplateFile(format, filename); m.compileErr != nil {
+				return
+			}
+			if m.Templates == nil {
+				m.Templates = make(map[string]AlertTemplate)
+			}
+			m.Templates[format] = tmpl
+		}
+		if m.Message != "" {
+			if m.messageRe, m.compileErr = regexp.Compile(m.Message); m.compileErr != nil {
+				return
+			}
+		}
+		for i := range m.Attrs {
+			if m.Attrs[i].Pattern == "" {
+				continue
+			}
+			if m.Attrs[i].re, m.compileErr = regexp.Compile(m.Attrs[i].Pattern); m.compileErr != nil {
+				return
+			}
+		}
+	})
+	if m.compileErr != nil {
+		return fmt.Errorf("metric %s: %w", m.Name, m.compileErr)
+	}
+	return nil
+}
+
+// minLevel keeps the default of the rules written before Level was honored,
+// which counted errors only.
+func (m *Metric) minLevel() slog.Level {
+	switch {
+	case m.MinLevel != nil:
+		return *m.MinLevel
+	case m.Level != 0:
+		return m.Level
+	}
+	return slog.LevelError
+}
+
+func (m *Metric) enabled(level slog.Level) bool {
+	return level >= m.minLevel() && (m.MaxLevel == nil || level <= *m.MaxLevel)
+}
+
+func (m *Metric) match(record *slog.Record) bool {
+	if !m.enabled(record.Level) || m.Validate() != nil {
+		return false
+	}
+	if m.messageRe != nil && !m.messageRe.MatchString(record.Message) {
+		return false
+	}
+	for i := range m.Attrs {
+		if !m.Attrs[i].match(record) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *Metric) sendNotification(now time.Time) {
+	m.lastNotify = now
+	m.nextNotifyTime = now.Add(m.NotifyPeriod)
 	if m.Notify == nil {
 		return
 	}
-	index := 0
-	if len(m.records) > 15 {
-		index = len(m.records) - 15
+	groups := m.groups()
+	data := m.alertData(now)
+	data.Groups = groups[:min(len(groups), m.maxGroups())]
+	data.Hidden = len(groups) - len(data.Groups)
+	data.Message = fmt.Sprintf("%s 内 %d 条日志，%d 组，阈值 %d，已持续 %s\n", m.EvaluatePeriod, len(m.records), len(groups), m.Threshold, data.Duration)
+	data.Message += formatAlertGroups(groups, m.maxGroups())
+	m.send(fmt.Sprintf("%s[警报]", m.Name), data)
+}
+
+func (m *Metric) alertData(now time.Time) *AlertData {
+	return &AlertData{
+		Title:     m.Name,
+		Status:    m.state,
+		Time:      now,
+		Count:     len(m.records),
+		Threshold: m.Threshold,
+		Peak:      m.peak,
+		Window:    m.EvaluatePeriod,
+		Duration:  now.Sub(m.firingSince).Round(time.Second),
+	}
+}
+
+func (m *Metric) groups() []*AlertGroup {
+	examples := m.GroupExamples
+	if examples <= 0 {
+		examples = defaultGroupExamples
 	}
-	var message string
-	for _, record := range m.records[index:] {
-		message += fmt.Sprintf("%-5s[%s] %-40s\t", record.Level, record.Time.Format("2006-01-02 15:04:05.99"), record.Message)
-		record.Attrs(func(attr slog.Attr) bool {
-			message += fmt.Sprintf("%s=%v\t", attr.Key, attr.Value)
-			return true
-		})
-		message += "\n"
+	return groupRecords(m.records, m.GroupBy, examples)
+}
+
+func (m *Metric) maxGroups() int {
+	if m.MaxGroups <= 0 {
+		return defaultMaxGroups
+	}
+	return m.MaxGroups
+}
+
+// Groups returns the records within EvaluatePeriod grouped by fingerprint.
+func (m *Metric) Groups() []*AlertGroup {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prune(time.Now())
+	return m.groups()
+}
+
+func (m *Metric) sendResolved(now time.Time) {
+	if m.Notify == nil {
+		return
+	}
+	data := m.alertData(now)
+	data.Message = fmt.Sprintf("告警已恢复\n持续时间: %s\n峰值: %d 条/%s\n", data.Duration, m.peak, m.EvaluatePeriod)
+	m.send(fmt.Sprintf("%s[恢复]", m.Name), data)
+}
+
+func (m *Metric) dispatcher() *Dispatcher {
+	if m.Dispatcher == nil {
+		return DefaultDispatcher()
+	}
+	return m.Dispatcher
+}
+
+// template returns the template for the format declared by Notify.
+func (m *Metric) template() AlertTemplate {
+	format := notifyFormat(m.Notify)
+	if tmpl, ok := m.Templates[format]; ok {
+		return tmpl
+	}
+	if tmpl, ok := DefaultTemplates[format]; ok {
+		return tmpl
 	}
+	return DefaultTemplate
+}
+
+func (m *Metric) send(title string, data *AlertData) {
 	builder := &strings.Builder{}
-	if err := DefaultTemplate.Execute(builder, map[string]any{
-		"Title":   m.Name,
-		"Message": message,
-		"Time":    time.Now(),
-	}); err != nil {
+	if err := m.template().Execute(builder, data); err != nil {
+		fmt.Fprintln(os.Stderr, "render notification error:", err)
 		return
 	}
-	// 发送通知信息
-	m.Notify.Send(fmt.Sprintf("%s[警报]", m.Name), builder.String())
+	// 发送通知信息，由 Dispatcher 在后台完成
+	if err := m.dispatcher().Dispatch(m.Notify, title, builder.String()); err != nil {
+		fmt.Fprintln(os.Stderr, "dispatch notification error:", err)
+	}
+}
+
+// prune drops the records that are older than EvaluatePeriod.
+func (m *Metric) prune(now time.Time) {
+	cutoffTime := now.Add(-m.EvaluatePeriod)
+	idx := sort.Search(len(m.records), func(i int) bool {
+		return m.records[i].Time.After(cutoffTime)
+	})
+	m.records = m.records[idx:]
+}
+
+func (m *Metric) snapshot() AlertSnapshot {
+	return AlertSnapshot{
+		State:        m.state,
+		LastNotify:   m.lastNotify,
+		NextNotify:   m.nextNotifyTime,
+		PendingSince: m.pendingSince,
+		FiringSince:  m.firingSince,
+		Peak:         m.peak,
+	}
+}
+
+// restore loads the alert saved by a previous process from Store.
+func (m *Metric) restore(now time.Time) {
+	m.restoreOnce.Do(func() {
+		if m.Store == nil {
+			return
+		}
+		snapshot, err := m.Store.Load(m.Name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "load alert %s error: %v\n", m.Name, err)
+			return
+		}
+		if snapshot == nil {
+			return
+		}
+		m.state = snapshot.State
+		m.lastNotify = snapshot.LastNotify
+		m.nextNotifyTime = snapshot.NextNotify
+		m.pendingSince = snapshot.PendingSince
+		m.firingSince = snapshot.FiringSince
+		m.peak = snapshot.Peak
+		m.restoredAt = now
+	})
+}
+
+func (m *Metric) save(before AlertSnapshot) {
+	if m.Store == nil {
+		return
+	}
+	snapshot := m.snapshot()
+	// Peak changes with almost every record, it is only saved along with
+	// a change of the state or of the cooldown.
+	changed := snapshot
+	changed.Peak = before.Peak
+	if changed == before {
+		return
+	}
+	// The store may write and sync a file, so it is called on a goroutine of
+	// its own rather than by the goroutine that logged. Only the latest
+	// snapshot waiting there is saved.
+	m.saveMu.Lock()
+	defer m.saveMu.Unlock()
+	m.saveNext = &snapshot
+	if m.saveDone == nil {
+		m.saveDone = make(chan struct{})
+		go m.saveLoop(m.saveDone)
+	}
+}
+
+func (m *Metric) saveLoop(done chan struct{}) {
+	defer close(done)
+	for {
+		m.saveMu.Lock()
+		snapshot := m.saveNext
+		m.saveNext = nil
+		if snapshot == nil {
+			m.saveDone = nil
+			m.saveMu.Unlock()
+			return
+		}
+		m.saveMu.Unlock()
+		if err := m.Store.Save(m.Name, snapshot); err != nil {
+			fmt.Fprintf(os.Stderr, "save alert %s error: %v\n", m.Name, err)
+		}
+	}
+}
+
+// waitSaved waits until the snapshots handed to the store are saved.
+func (m *Metric) waitSaved() {
+	m.saveMu.Lock()
+	done := m.saveDone
+	m.saveMu.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// evaluate moves the alert to its next state.
+func (m *Metric) evaluate(now time.Time) {
+	m.restore(now)
+	defer m.save(m.snapshot())
+	m.prune(now)
+	count := len(m.records)
+	if count < max(m.Threshold, 1) {
+		// The records were lost with the previous process, an open alert is
+		// kept until a whole EvaluatePeriod was counted again.
+		if !m.restoredAt.IsZero() && now.Sub(m.restoredAt) < m.EvaluatePeriod {
+			return
+		}
+		switch m.state {
+		case AlertPending:
+			m.state = AlertInactive
+		case AlertFiring:
+			m.state = AlertResolved
+			m.sendResolved(now)
+		}
+		return
+	}
+	switch m.state {
+	case AlertInactive, AlertResolved:
+		m.state = AlertPending
+		m.pendingSince = now
+		m.peak = count
+	}
+	m.peak = max(m.peak, count)
+	switch m.state {
+	case AlertPending:
+		if now.Sub(m.pendingSince) >= m.For {
+			m.state = AlertFiring
+			m.firingSince = now
+			m.sendNotification(now)
+		}
+	case AlertFiring:
+		// Without NotifyPeriod only the firing and resolved messages are sent.
+		if m.NotifyPeriod > 0 && !now.Before(m.nextNotifyTime) {
+			m.sendNotification(now)
+		}
+	}
+}
+
+// Evaluate updates the alert state, it is called for every matching record
+// and periodically by MetricHandler.Start.
+func (m *Metric) Evaluate(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.evaluate(now)
+}
+
+func (m *Metric) State() AlertState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.restore(time.Now())
+	return m.state
 }
 
 func (m *Metric) Handle(record *slog.Record) {
-	if record.Level < slog.LevelError { // 只统计 ERROR 及以上的日志
+	if !m.match(record) {
 		return
 	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	// 添加日志
 	m.records = append(m.records, record)
-	cutoffTime := time.Now().Add(-m.EvaluatePeriod)
-	idx := sort.Search(len(m.records), func(i int) bool {
-		return m.records[i].Time.After(cutoffTime)
-	})
-	m.records = m.records[idx:]
-	if len(m.records) >= m.Threshold && time.Now().After(m.lastNotify) {
-		m.sendNotification()
-	}
+	m.evaluate(time.Now())
+}
+
+// metricEvaluator controls the goroutine started by Start, there is at most one
+// no matter how often Start is called.
+type metricEvaluator struct {
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
 }
 
+// MetricHandler evaluates every record against its metrics before passing it
+// on to the wrapped handler.
 type MetricHandler struct {
 	handler slog.Handler
-	metric  *Metric
+	metrics []*Metric
+	attrs   []slog.Attr // 展开后的属性，供 AttrMatcher 使用
+	group   string
+	eval    *metricEvaluator
 }
 
 func (m *MetricHandler) Enabled(ctx context.Context, level slog.Level) bool {
-	return m.handler.Enabled(ctx, level)
+	return m.handler.Enabled(ctx, level) || m.metricsEnabled(level)
+}
+
+func (m *MetricHandler) metricsEnabled(level slog.Level) bool {
+	for _, metric := range m.metrics {
+		if metric.enabled(level) {
+			return true
+		}
+	}
+	return false
 }
 
 func (m *MetricHandler) Handle(ctx context.Context, record slog.Record) error {
-	m.metric.Handle(&record)
+	if m.metricsEnabled(record.Level) {
+		// The metrics keep the record, so they get a copy that also holds
+		// the attributes added by WithAttrs.
+		stored := slog.NewRecord(record.Time, record.Level, record.Message, record.PC)
+		stored.AddAttrs(flattenRecord(m.attrs, m.group, record)...)
+		for _, metric := range m.metrics {
+			metric.Handle(&stored)
+		}
+	}
 	if m.handler.Enabled(ctx, record.Level) {
 		return m.handler.Handle(ctx, record)
 	}
@@ -127,20 +507,157 @@ func (m *MetricHandler) Handle(ctx context.Context, record slog.Record) error {
 func (m *MetricHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
 	return &MetricHandler{
 		handler: m.handler.WithAttrs(attrs),
-		metric:  m.metric,
+		metrics: m.metrics,
+		attrs:   appendFlatAttrs(m.attrs[:len(m.attrs):len(m.attrs)], m.group, attrs...),
+		group:   m.group,
+		eval:    m.eval,
 	}
 }
 
 func (m *MetricHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return m
+	}
 	return &MetricHandler{
 		handler: m.handler.WithGroup(name),
-		metric:  m.metric,
+		metrics: m.metrics,
+		attrs:   m.attrs,
+		group:   m.group + name + ".",
+		eval:    m.eval,
+	}
+}
+
+func (m *MetricHandler) handlers() []slog.Handler {
+	return []slog.Handler{m.handler}
+}
+
+// Start evaluates all metrics every interval in the background, so that
+// pending alerts fire and firing alerts resolve without new records. An
+// interval <= 0 selects the shortest EvaluatePeriod of the metrics.
+func (m *MetricHandler) Start(interval time.Duration) {
+	m.eval.mu.Lock()
+	defer m.eval.mu.Unlock()
+	if m.eval.stop != nil {
+		return
+	}
+	if interval <= 0 {
+		interval = m.evaluateInterval()
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	m.eval.stop, m.eval.done = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				for _, metric := range m.metrics {
+					metric.Evaluate(now)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// evaluateInterval returns the shortest EvaluatePeriod, or a minute if no
+// metric has one.
+func (m *MetricHandler) evaluateInterval() time.Duration {
+	interval := time.Duration(0)
+	for _, metric := range m.metrics {
+		if metric.EvaluatePeriod > 0 && (interval == 0 || metric.EvaluatePeriod < interval) {
+			interval = metric.EvaluatePeriod
+		}
+	}
+	if interval == 0 {
+		return time.Minute
+	}
+	return interval
+}
+
+// Stop ends the background evaluation started by Start.
+func (m *MetricHandler) Stop() {
+	m.eval.mu.Lock()
+	defer m.eval.mu.Unlock()
+	if m.eval.stop == nil {
+		return
 	}
+	close(m.eval.stop)
+	<-m.eval.done
+	m.eval.stop, m.eval.done = nil, nil
+}
+
+// Flush waits until the notifications sent by the metrics were delivered.
+func (m *MetricHandler) Flush() error {
+	flushed := make(map[*Dispatcher]bool)
+	for _, metric := range m.metrics {
+		metric.waitSaved()
+		if metric.Notify == nil {
+			continue
+		}
+		if d := metric.dispatcher(); !flushed[d] {
+			flushed[d] = true
+			d.Flush()
+		}
+	}
+	return nil
 }
 
-func NewMetricHandler(h slog.Handler, metric *Metric) *MetricHandler {
+// Close stops the background evaluation and flushes the notifications. The
+// dispatchers are left open, they may be shared with other handlers.
+func (m *MetricHandler) Close() error {
+	m.Stop()
+	return m.Flush()
+}
+
+// NewMetricHandler wraps h with one or more metrics, each evaluated on its own.
+// A metric that does not validate is reported on stderr and never matches.
+func NewMetricHandler(h slog.Handler, metrics ...*Metric) *MetricHandler {
+	if err := validateMetrics(metrics); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid metric:", err)
+	}
+	return newMetricHandler(h, metrics)
+}
+
+// NewMetricHandlers is NewMetricHandler failing if a metric does not validate
+// or has the name of another one.
+func NewMetricHandlers(h slog.Handler, metrics ...*Metric) (*MetricHandler, error) {
+	if err := validateMetrics(metrics); err != nil {
+		return nil, err
+	}
+	return newMetricHandler(h, metrics), nil
+}
+
+// validateMetrics validates every metric and checks that their names, the keys
+// of their alerts in a Store, are unique.
+func validateMetrics(metrics []*Metric) error {
+	var errs []error
+	names := make(map[string]bool)
+	for _, metric := range metrics {
+		if err := metric.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+		if names[metric.Name] {
+			errs = append(errs, fmt.Errorf("metric %s: duplicate name", metric.Name))
+		}
+		names[metric.Name] = true
+	}
+	return errors.Join(errs...)
+}
+
+func newMetricHandler(h slog.Handler, metrics []*Metric) *MetricHandler {
+	// The saved alerts are loaded now, not by the first record.
+	now := time.Now()
+	for _, metric := range metrics {
+		metric.mu.Lock()
+		metric.restore(now)
+		metric.mu.Unlock()
+	}
 	return &MetricHandler{
 		handler: h,
-		metric:  metric,
+		metrics: metrics,
+		eval:    &metricEvaluator{},
 	}
 }
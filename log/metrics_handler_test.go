@@ -0,0 +1,512 @@
+package log
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testNotify records the notifications, delivered by its own dispatcher so
+// that the tests don't wait for each other.
+type testNotify struct {
+	dispatcher *Dispatcher
+	mu         sync.Mutex
+	titles     []string
+	contents   []string
+}
+
+func (n *testNotify) Send(title string, content string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.titles = append(n.titles, title)
+	n.contents = append(n.contents, content)
+}
+
+func newTestNotify() *testNotify {
+	return &testNotify{dispatcher: NewDispatcher(100, 1)}
+}
+
+func (n *testNotify) sent() int {
+	n.dispatcher.Flush()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.titles)
+}
+
+func TestMetricRules(t *testing.T) {
+	var (
+		proxy = newTestNotify()
+		fatal = newTestNotify()
+		info  = LevelInfo
+	)
+	proxyRule := &Metric{
+		Notify:         proxy,
+		Dispatcher:     proxy.dispatcher,
+		Name:           "proxy",
+		MinLevel:       &info,
+		MaxLevel:       &info,
+		Message:        "^proxy (failed|timeout)$",
+		Attrs:          []AttrMatcher{{Key: "svc.ip", Pattern: `^10\.`}},
+		NotifyPeriod:   time.Hour,
+		EvaluatePeriod: time.Minute,
+		Threshold:      5,
+	}
+	fatalRule := &Metric{
+		Notify:         fatal,
+		Dispatcher:     fatal.dispatcher,
+		Name:           "fatal",
+		Level:          LevelFatal,
+		NotifyPeriod:   time.Hour,
+		EvaluatePeriod: time.Minute,
+		Threshold:      1,
+	}
+	h := NewMetricHandler(NewTerminalHandlerWithLevel(io.Discard, LevelError, false), proxyRule, fatalRule)
+	l := NewLogger(h.WithGroup("svc"))
+	for i := 0; i < 4; i++ {
+		l.Info("proxy failed", "ip", "10.0.0.1")
+		l.Info("proxy failed", "ip", "192.168.0.1")
+		l.Error("proxy failed", "ip", "10.0.0.1")
+	}
+	if proxy.sent() != 0 {
+		t.Fatalf("proxy rule fired after 4 matching records")
+	}
+	l.Info("proxy timeout", "ip", "10.0.0.2")
+	if proxy.sent() != 1 || fatal.sent() != 0 {
+		t.Fatalf("have %d proxy and %d fatal notifications, want 1 and 0", proxy.sent(), fatal.sent())
+	}
+	l.Write(LevelFatal, "boom")
+	if fatal.sent() != 1 {
+		t.Fatalf("fatal rule did not fire")
+	}
+
+	bad := &Metric{Name: "bad", Message: "("}
+	if _, err := NewMetricHandlers(NewTerminalHandler(io.Discard, false), fatalRule, bad); err == nil || !regexp.MustCompile("^metric bad: ").MatchString(err.Error()) {
+		t.Errorf("unexpected validation error %v", err)
+	}
+	if _, err := NewMetricHandlers(NewTerminalHandler(io.Discard, false), fatalRule, &Metric{Name: "fatal"}); err == nil || err.Error() != "metric fatal: duplicate name" {
+		t.Errorf("unexpected error %v for a duplicate name", err)
+	}
+}
+
+// TestMetricDefaultLevel checks that a rule without a level counts errors
+// only, as Metric did before it had level ranges.
+func TestMetricDefaultLevel(t *testing.T) {
+	n := newTestNotify()
+	rule := &Metric{Notify: n, Dispatcher: n.dispatcher, Name: "errors", NotifyPeriod: time.Hour, EvaluatePeriod: time.Minute, Threshold: 2}
+	l := NewLogger(NewMetricHandler(NewTerminalHandler(io.Discard, false), rule))
+	for i := 0; i < 3; i++ {
+		l.Info("ignored")
+		l.Warn("ignored")
+	}
+	l.Error("counted")
+	if n.sent() != 0 {
+		t.Fatal("records below ERROR were counted")
+	}
+	l.Error("counted")
+	if n.sent() != 1 {
+		t.Fatalf("have %d notifications, want 1", n.sent())
+	}
+}
+
+func TestMetricAlertStates(t *testing.T) {
+	var (
+		n    = newTestNotify()
+		rule = &Metric{
+			Notify:         n,
+			Dispatcher:     n.dispatcher,
+			Name:           "dial",
+			Level:          LevelError,
+			NotifyPeriod:   time.Hour,
+			EvaluatePeriod: time.Minute,
+			Threshold:      3,
+			For:            10 * time.Second,
+		}
+		l     = NewLogger(NewMetricHandler(NewTerminalHandler(io.Discard, false), rule))
+		start = time.Now()
+	)
+	for i := 0; i < 4; i++ {
+		l.Error("dial failed")
+	}
+	if rule.State() != AlertPending || n.sent() != 0 {
+		t.Fatalf("have state %s and %d notifications, want pending and 0", rule.State(), n.sent())
+	}
+	rule.Evaluate(start.Add(20 * time.Second))
+	if rule.State() != AlertFiring || n.sent() != 1 || !strings.HasSuffix(n.titles[0], "[警报]") {
+		t.Fatalf("have state %s and %d notifications, want firing and 1", rule.State(), n.sent())
+	}
+	rule.Evaluate(start.Add(30 * time.Second))
+	if n.sent() != 1 {
+		t.Fatalf("firing alert notified again within the notify period")
+	}
+	rule.Evaluate(start.Add(2 * time.Minute))
+	if rule.State() != AlertResolved || n.sent() != 2 || !strings.HasSuffix(n.titles[1], "[恢复]") {
+		t.Fatalf("have state %s and %d notifications, want resolved and 2", rule.State(), n.sent())
+	}
+	if !strings.Contains(n.contents[1], "峰值: 4 条") || !strings.Contains(n.contents[1], "持续时间: 1m40s") {
+		t.Errorf("resolved message lacks peak or duration: %s", n.contents[1])
+	}
+}
+
+func TestMetricHandlerStart(t *testing.T) {
+	n := newTestNotify()
+	rule := &Metric{Notify: n, Dispatcher: n.dispatcher, Level: LevelError, EvaluatePeriod: 50 * time.Millisecond, Threshold: 1}
+	h := NewMetricHandler(NewTerminalHandler(io.Discard, false), rule)
+	h.Start(10 * time.Millisecond)
+	defer h.Stop()
+	NewLogger(h).Error("boom")
+	deadline := time.Now().Add(5 * time.Second)
+	for rule.State() != AlertResolved && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rule.State() != AlertResolved || n.sent() != 2 {
+		t.Errorf("have state %s and %d notifications, want resolved and 2", rule.State(), n.sent())
+	}
+
+	// Without an interval the rules are evaluated every EvaluatePeriod.
+	n = newTestNotify()
+	rule = &Metric{Notify: n, Dispatcher: n.dispatcher, Level: LevelError, EvaluatePeriod: 20 * time.Millisecond, Threshold: 1}
+	h = NewMetricHandler(NewTerminalHandler(io.Discard, false), rule, &Metric{Level: LevelError, EvaluatePeriod: time.Hour, Threshold: 100})
+	if interval := h.evaluateInterval(); interval != 20*time.Millisecond {
+		t.Errorf("have interval %s", interval)
+	}
+	h.Start(0)
+	defer h.Stop()
+	NewLogger(h).Error("boom")
+	deadline = time.Now().Add(5 * time.Second)
+	for rule.State() != AlertResolved && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rule.State() != AlertResolved {
+		t.Errorf("have state %s without an interval, want resolved", rule.State())
+	}
+}
+
+type flakyNotify struct {
+	calls atomic.Int32
+	fail  int32
+	delay time.Duration
+}
+
+func (n *flakyNotify) Send(title string, content string) {}
+
+func (n *flakyNotify) SendContext(ctx context.Context, title string, content string) error {
+	select {
+	case <-time.After(n.delay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if n.calls.Add(1) <= n.fail {
+		return errors.New("smtp unavailable")
+	}
+	return nil
+}
+
+func TestDispatcher(t *testing.T) {
+	d := NewDispatcher(2, 1)
+	d.Timeout = 20 * time.Millisecond
+	d.Retries = 2
+	d.Backoff = time.Millisecond
+	slow := &flakyNotify{delay: time.Hour}
+	flaky := &flakyNotify{fail: 2}
+
+	start := time.Now()
+	d.Dispatch(slow, "slow", "")
+	d.Dispatch(flaky, "flaky", "")
+	for i := 0; i < 5; i++ {
+		d.Dispatch(flaky, "dropped", "")
+	}
+	if time.Since(start) > 10*time.Millisecond {
+		t.Fatalf("Dispatch blocked for %s", time.Since(start))
+	}
+	// Close would give up the retries, so the test waits for them.
+	for deadline := time.Now().Add(5 * time.Second); d.Stats().Sent+d.Stats().Failed < 2 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	d.Close()
+	stats := d.Stats()
+	if stats.Sent != 1 || stats.Failed != 1 || stats.Retried != 4 || stats.Dropped+stats.Queued != 7 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if err := d.Dispatch(flaky, "closed", ""); err != ErrDispatcherClosed {
+		t.Errorf("have %v after close, want ErrDispatcherClosed", err)
+	}
+}
+
+func TestDispatcherCloseDuringBackoff(t *testing.T) {
+	d := NewDispatcher(2, 1)
+	d.Timeout = time.Second
+	d.Backoff = time.Hour
+	failing := &flakyNotify{fail: 100}
+	d.Dispatch(failing, "failing", "")
+	for failing.calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	start := time.Now()
+	d.Flush()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Flush waited %s for the backoff", elapsed)
+	}
+	d.Dispatch(failing, "failing again", "")
+	for failing.calls.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	d.Close()
+	if stats := d.Stats(); stats.Failed != 2 || stats.Retried != 0 || time.Since(start) > 2*time.Second {
+		t.Errorf("unexpected stats %+v after %s", stats, time.Since(start))
+	}
+}
+
+type slowNotify struct {
+	calls, running, overlapped atomic.Int32
+}
+
+func (n *slowNotify) Send(title string, content string) {
+	n.calls.Add(1)
+	if n.running.Add(1) > 1 {
+		n.overlapped.Add(1)
+	}
+	time.Sleep(30 * time.Millisecond)
+	n.running.Add(-1)
+}
+
+func TestDispatcherPlainNotify(t *testing.T) {
+	d := NewDispatcher(4, 2)
+	d.Timeout = 5 * time.Millisecond
+	d.Backoff = time.Millisecond
+	n := &slowNotify{}
+	d.Dispatch(n, "slow", "")
+	d.Flush()
+	// A Notify without SendContext can't be interrupted, so it is neither
+	// abandoned nor retried after the timeout.
+	if n.calls.Load() != 1 || n.overlapped.Load() != 0 || d.Stats().Retried != 0 {
+		t.Errorf("have %d calls, %d overlapping, stats %+v", n.calls.Load(), n.overlapped.Load(), d.Stats())
+	}
+	d.Close()
+}
+
+func TestMetricGroups(t *testing.T) {
+	n := newTestNotify()
+	rule := &Metric{
+		Notify:         n,
+		Dispatcher:     n.dispatcher,
+		Name:           "dial",
+		Level:          LevelError,
+		EvaluatePeriod: time.Minute,
+		Threshold:      600,
+		GroupBy:        []string{"ip"},
+		MaxGroups:      2,
+		GroupExamples:  2,
+	}
+	l := NewLogger(NewMetricHandler(NewTerminalHandler(io.Discard, false), rule))
+	for i := 0; i < 500; i++ {
+		l.Error("dial failed", "ip", "10.0.0.1", "i", i)
+	}
+	for i := 0; i < 99; i++ {
+		l.Error("dial failed", "ip", "10.0.0.2", "i", i)
+	}
+	l.Error("read failed", "ip", "10.0.0.1")
+
+	groups := rule.Groups()
+	if len(groups) != 3 || groups[0].Count != 500 || groups[1].Count != 99 || groups[2].Message != "read failed" {
+		t.Fatalf("unexpected groups %+v", groups)
+	}
+	if len(groups[0].Examples) != 2 || !hasAttr(*groups[0].Examples[1], "i", "499") {
+		t.Errorf("want the 2 latest examples, have %v", groups[0].Examples)
+	}
+	if n.sent() != 1 {
+		t.Fatalf("have %d notifications, want 1", n.sent())
+	}
+	content := n.contents[0]
+	for _, want := range []string{"600 条日志，3 组", "[500次] dial failed ip=10.0.0.1", "[99次] dial failed ip=10.0.0.2", "其余 1 组未显示"} {
+		if !strings.Contains(content, want) {
+			t.Errorf("notification lacks %q:\n%s", want, content)
+		}
+	}
+	if strings.Count(content, "例: ") != 4 {
+		t.Errorf("want 4 examples:\n%s", content)
+	}
+}
+
+type textNotify struct {
+	*testNotify
+	format string
+}
+
+func (n textNotify) Format() string {
+	return n.format
+}
+
+func TestMetricTemplates(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "alert.tmpl")
+	if err := os.WriteFile(file, []byte(`{{.Title}} {{.Status}} {{.Count}}/{{.Threshold}}{{range .Groups}} {{level (index .Examples 0).Level}}{{end}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		format string
+		files  map[string]string
+		want   []string
+		lacks  string
+	}{
+		{format: FormatText, want: []string{"1m0s 内 3 条日志，阈值 3", "[3次] dial failed ip=10.0.0.1", "ERROR dial failed"}, lacks: "<"},
+		{format: FormatMarkdown, want: []string{"**dial** 告警", "**[3次] dial failed** ip=10.0.0.1", "```"}, lacks: "<div"},
+		{format: FormatHTML, want: []string{"<div", "[3次] dial failed"}},
+		{format: FormatText, files: map[string]string{FormatText: file}, want: []string{"dial firing 3/3 ERROR"}},
+	} {
+		n := textNotify{testNotify: newTestNotify(), format: tt.format}
+		rule := &Metric{
+			Notify:         n,
+			Dispatcher:     n.dispatcher,
+			Name:           "dial",
+			Level:          LevelError,
+			EvaluatePeriod: time.Minute,
+			Threshold:      3,
+			GroupBy:        []string{"ip"},
+			TemplateFiles:  tt.files,
+		}
+		if err := rule.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		l := NewLogger(NewMetricHandler(NewTerminalHandler(io.Discard, false), rule))
+		for i := 0; i < 3; i++ {
+			l.Error("dial failed", "ip", "10.0.0.1")
+		}
+		if n.sent() != 1 {
+			t.Fatalf("%s: have %d notifications, want 1", tt.format, n.sent())
+		}
+		content := n.contents[0]
+		for _, want := range tt.want {
+			if !strings.Contains(content, want) {
+				t.Errorf("%s: notification lacks %q:\n%s", tt.format, want, content)
+			}
+		}
+		if tt.lacks != "" && strings.Contains(content, tt.lacks) {
+			t.Errorf("%s: notification contains %q:\n%s", tt.format, tt.lacks, content)
+		}
+	}
+
+	rule := &Metric{Name: "broken", TemplateFiles: map[string]string{FormatText: file + ".missing"}}
+	if err := rule.Validate(); err == nil {
+		t.Error("want an error for a missing template file")
+	}
+}
+
+func TestMetricStore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "alerts.json")
+	newRule := func(n *testNotify) *Metric {
+		return &Metric{
+			Notify:         n,
+			Dispatcher:     n.dispatcher,
+			Store:          NewFileAlertStore(file),
+			Name:           "crash",
+			Level:          LevelError,
+			NotifyPeriod:   time.Hour,
+			EvaluatePeriod: time.Minute,
+			Threshold:      2,
+		}
+	}
+	start := time.Now()
+	n := newTestNotify()
+	rule := newRule(n)
+	h := NewMetricHandler(NewTerminalHandler(io.Discard, false), rule)
+	l := NewLogger(h)
+	l.Error("boom")
+	l.Error("boom")
+	h.Flush()
+	if rule.State() != AlertFiring || n.sent() != 1 {
+		t.Fatalf("have %v with %d notifications, want firing with 1", rule.State(), n.sent())
+	}
+
+	// A restarted process keeps the alert open and respects the cooldown.
+	n = newTestNotify()
+	rule = newRule(n)
+	if rule.State() != AlertFiring {
+		t.Fatalf("have %v after restart, want firing", rule.State())
+	}
+	rule.Evaluate(start.Add(30 * time.Second))
+	h = NewMetricHandler(NewTerminalHandler(io.Discard, false), rule)
+	l = NewLogger(h)
+	l.Error("boom")
+	l.Error("boom")
+	if rule.State() != AlertFiring || n.sent() != 0 {
+		t.Fatalf("have %v with %d notifications, want firing with none", rule.State(), n.sent())
+	}
+
+	rule.Evaluate(start.Add(3 * time.Minute))
+	h.Flush()
+	if rule.State() != AlertResolved || n.sent() != 1 || n.titles[0] != "crash[恢复]" {
+		t.Fatalf("have %v with %v, want resolved", rule.State(), n.titles)
+	}
+	snapshot, err := NewFileAlertStore(file).Load("crash")
+	if err != nil || snapshot == nil || snapshot.State != AlertResolved {
+		t.Fatalf("have saved %+v, %v", snapshot, err)
+	}
+}
+
+type countingStore struct {
+	AlertStore
+	saves atomic.Int32
+}
+
+func (s *countingStore) Save(name string, snapshot *AlertSnapshot) error {
+	s.saves.Add(1)
+	return s.AlertStore.Save(name, snapshot)
+}
+
+func TestMetricStoreSaves(t *testing.T) {
+	store := &countingStore{AlertStore: NewFileAlertStore(filepath.Join(t.TempDir(), "alerts.json"))}
+	rule := &Metric{Store: store, Name: "errors", Level: LevelError, NotifyPeriod: time.Hour, EvaluatePeriod: time.Minute, Threshold: 2}
+	h := NewMetricHandler(NewTerminalHandler(io.Discard, false), rule)
+	l := NewLogger(h)
+	for i := 0; i < 200; i++ {
+		l.Error("boom")
+	}
+	h.Flush()
+	// Only the change to firing with its cooldown is saved, not the peaks.
+	if saves := store.saves.Load(); saves != 1 {
+		t.Errorf("have %d saves, want 1", saves)
+	}
+}
+
+// blockedStore never finishes a Save until it is released.
+type blockedStore struct {
+	AlertStore
+	release chan struct{}
+}
+
+func (s *blockedStore) Save(name string, snapshot *AlertSnapshot) error {
+	<-s.release
+	return s.AlertStore.Save(name, snapshot)
+}
+
+func TestMetricStoreOffLoggingPath(t *testing.T) {
+	store := &blockedStore{AlertStore: NewFileAlertStore(filepath.Join(t.TempDir(), "alerts.json")), release: make(chan struct{})}
+	rule := &Metric{Store: store, Name: "errors", NotifyPeriod: time.Millisecond, EvaluatePeriod: time.Minute, Threshold: 1}
+	h := NewMetricHandler(NewTerminalHandler(io.Discard, false), rule)
+	l := NewLogger(h)
+	logged := make(chan struct{})
+	go func() {
+		for i := 0; i < 50; i++ {
+			l.Error("boom")
+			time.Sleep(time.Millisecond)
+		}
+		close(logged)
+	}()
+	select {
+	case <-logged:
+	case <-time.After(5 * time.Second):
+		t.Fatal("logging waited for the store")
+	}
+	close(store.release)
+	h.Flush()
+	if snapshot, err := store.Load("errors"); err != nil || snapshot == nil || snapshot.State != AlertFiring {
+		t.Errorf("have saved %+v, %v", snapshot, err)
+	}
+}
@@ -0,0 +1,148 @@
+package log
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+)
+
+// Sink is one destination of a MultiHandler.
+type Sink struct {
+	Handler slog.Handler
+	// Level is the minimum level passed to Handler, nil accepts every level
+	// Handler itself is enabled for.
+	Level slog.Leveler
+	// Filter, if set, must return true for a record to reach Handler. The
+	// record it receives also carries the attributes added through WithAttrs,
+	// with keys qualified by the open groups, e.g. http.method.
+	Filter func(r slog.Record) bool
+}
+
+func (s *Sink) enabled(ctx context.Context, level slog.Level) bool {
+	if s.Level != nil && level < s.Level.Level() {
+		return false
+	}
+	return s.Handler.Enabled(ctx, level)
+}
+
+// MultiHandler dispatches every record to several handlers.
+type MultiHandler struct {
+	sinks []Sink
+	attrs []slog.Attr // 仅供 Filter 使用
+	group string
+}
+
+func (m *MultiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for i := range m.sinks {
+		if m.sinks[i].enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MultiHandler) Handle(ctx context.Context, r slog.Record) error {
+	var (
+		errs     []error
+		filtered *slog.Record
+	)
+	for i := range m.sinks {
+		sink := &m.sinks[i]
+		if !sink.enabled(ctx, r.Level) {
+			continue
+		}
+		if sink.Filter != nil {
+			if filtered == nil {
+				filtered = m.filterRecord(r)
+			}
+			if !sink.Filter(*filtered) {
+				continue
+			}
+		}
+		if err := sink.Handler.Handle(ctx, r.Clone()); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// filterRecord returns a copy of r holding the handler attributes followed by
+// the record attributes, all flattened.
+func (m *MultiHandler) filterRecord(r slog.Record) *slog.Record {
+	fr := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	fr.AddAttrs(flattenRecord(m.attrs, m.group, r)...)
+	return &fr
+}
+
+func (m *MultiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	sinks := make([]Sink, len(m.sinks))
+	for i, sink := range m.sinks {
+		sink.Handler = sink.Handler.WithAttrs(attrs)
+		sinks[i] = sink
+	}
+	return &MultiHandler{
+		sinks: sinks,
+		attrs: appendFlatAttrs(m.attrs[:len(m.attrs):len(m.attrs)], m.group, attrs...),
+		group: m.group,
+	}
+}
+
+func (m *MultiHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return m
+	}
+	sinks := make([]Sink, len(m.sinks))
+	for i, sink := range m.sinks {
+		sink.Handler = sink.Handler.WithGroup(name)
+		sinks[i] = sink
+	}
+	return &MultiHandler{
+		sinks: sinks,
+		attrs: m.attrs,
+		group: m.group + name + ".",
+	}
+}
+
+func (m *MultiHandler) handlers() []slog.Handler {
+	handlers := make([]slog.Handler, len(m.sinks))
+	for i, sink := range m.sinks {
+		handlers[i] = sink.Handler
+	}
+	return handlers
+}
+
+func NewMultiHandler(sinks ...Sink) *MultiHandler {
+	return &MultiHandler{
+		sinks: sinks,
+	}
+}
+
+// MatchMessage returns a Sink.Filter accepting records whose message matches re.
+func MatchMessage(re *regexp.Regexp) func(slog.Record) bool {
+	return func(r slog.Record) bool {
+		return re.MatchString(r.Message)
+	}
+}
+
+// MatchAttr returns a Sink.Filter accepting records that have an attribute
+// with the given key whose value prints as fmt.Sprint(value).
+func MatchAttr(key string, value any) func(slog.Record) bool {
+	want := fmt.Sprint(value)
+	return func(r slog.Record) bool {
+		return hasAttr(r, key, want)
+	}
+}
+
+// hasAttr reports whether r has an attribute key whose value prints as want.
+func hasAttr(r slog.Record, key string, want string) bool {
+	found := false
+	r.Attrs(func(attr slog.Attr) bool {
+		if attr.Key == key && attr.Value.String() == want {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
@@ -0,0 +1,284 @@
+package log
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PrometheusOptions configures a PrometheusHandler.
+type PrometheusOptions struct {
+	Namespace string         // 指标名前缀，默认 log
+	Level     slog.Leveler   // 统计的最低级别，为空时只统计内部 handler 输出的日志
+	Message   bool           // 是否按日志消息统计
+	Labels    []string       // 作为标签的属性，分组内的键为 http.method 形式，level、msg 属性的标签为 attr_level、attr_msg，重名的标签加上 _2 等后缀
+	MaxSeries int            // 最多的时间序列数，超过后计入 overflow，默认 1000
+	Alerts    *MetricHandler // 同时输出其中告警的状态
+}
+
+type promSeries struct {
+	labels string
+	count  uint64
+}
+
+// promCounters maps the labels of each series to its count, records beyond
+// MaxSeries series are only counted as overflow.
+type promCounters struct {
+	mu       sync.Mutex
+	series   map[string]*promSeries
+	overflow uint64
+}
+
+// PrometheusHandler counts records by level, message and attribute labels
+// and serves the counters in the Prometheus text format.
+type PrometheusHandler struct {
+	handler  slog.Handler
+	opts     *PrometheusOptions
+	labels   []string // Labels 对应的标签名
+	counters *promCounters
+	attrs    []slog.Attr
+	group    string
+}
+
+func (h *PrometheusHandler) counted(ctx context.Context, level slog.Level) bool {
+	if h.opts.Level == nil {
+		return h.handler.Enabled(ctx, level)
+	}
+	return level >= h.opts.Level.Level()
+}
+
+func (h *PrometheusHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level) || h.counted(ctx, level)
+}
+
+func (h *PrometheusHandler) Handle(ctx context.Context, r slog.Record) error {
+	if h.counted(ctx, r.Level) {
+		h.count(&r)
+	}
+	if h.handler.Enabled(ctx, r.Level) {
+		return h.handler.Handle(ctx, r)
+	}
+	return nil
+}
+
+func (h *PrometheusHandler) count(r *slog.Record) {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, `level=%q`, LevelString(r.Level))
+	if h.opts.Message {
+		b.WriteString(`,msg="`)
+		writePromValue(b, r.Message)
+		b.WriteByte('"')
+	}
+	if len(h.opts.Labels) > 0 {
+		attrs := flattenRecord(h.attrs, h.group, *r)
+		for i, key := range h.opts.Labels {
+			value := ""
+			for _, attr := range attrs {
+				if attr.Key == key {
+					value = attr.Value.String()
+				}
+			}
+			fmt.Fprintf(b, `,%s="`, h.labels[i])
+			writePromValue(b, value)
+			b.WriteByte('"')
+		}
+	}
+	labels := b.String()
+
+	c := h.counters
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.series[labels]
+	if !ok {
+		if len(c.series) >= h.maxSeries() {
+			c.overflow++
+			return
+		}
+		s = &promSeries{labels: labels}
+		c.series[labels] = s
+	}
+	s.count++
+}
+
+func (h *PrometheusHandler) maxSeries() int {
+	if h.opts.MaxSeries <= 0 {
+		return 1000
+	}
+	return h.opts.MaxSeries
+}
+
+func (h *PrometheusHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &PrometheusHandler{
+		handler:  h.handler.WithAttrs(attrs),
+		opts:     h.opts,
+		labels:   h.labels,
+		counters: h.counters,
+		attrs:    appendFlatAttrs(h.attrs[:len(h.attrs):len(h.attrs)], h.group, attrs...),
+		group:    h.group,
+	}
+}
+
+func (h *PrometheusHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &PrometheusHandler{
+		handler:  h.handler.WithGroup(name),
+		opts:     h.opts,
+		labels:   h.labels,
+		counters: h.counters,
+		attrs:    h.attrs,
+		group:    h.group + name + ".",
+	}
+}
+
+func (h *PrometheusHandler) handlers() []slog.Handler {
+	return []slog.Handler{h.handler}
+}
+
+// WriteTo writes the counters, and the state of the alerts if Alerts is set,
+// in the Prometheus text format.
+func (h *PrometheusHandler) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	cw := &countingWriter{w: bw}
+	ns := h.opts.Namespace
+	if ns == "" {
+		ns = "log"
+	}
+
+	c := h.counters
+	c.mu.Lock()
+	series := make([]promSeries, 0, len(c.series))
+	for _, s := range c.series {
+		series = append(series, *s)
+	}
+	overflow := c.overflow
+	c.mu.Unlock()
+	sort.Slice(series, func(i, j int) bool {
+		return series[i].labels < series[j].labels
+	})
+
+	fmt.Fprintf(cw, "# HELP %s_records_total Number of log records.\n", ns)
+	fmt.Fprintf(cw, "# TYPE %s_records_total counter\n", ns)
+	for _, s := range series {
+		fmt.Fprintf(cw, "%s_records_total{%s} %d\n", ns, s.labels, s.count)
+	}
+	fmt.Fprintf(cw, "# HELP %s_records_overflow_total Number of log records not counted because of MaxSeries.\n", ns)
+	fmt.Fprintf(cw, "# TYPE %s_records_overflow_total counter\n", ns)
+	fmt.Fprintf(cw, "%s_records_overflow_total %d\n", ns, overflow)
+
+	if h.opts.Alerts != nil {
+		fmt.Fprintf(cw, "# HELP %s_alert_state State of the alert of a metric, 1 for the current state.\n", ns)
+		fmt.Fprintf(cw, "# TYPE %s_alert_state gauge\n", ns)
+		for _, metric := range h.opts.Alerts.metrics {
+			current := metric.State()
+			for _, state := range []AlertState{AlertInactive, AlertPending, AlertFiring, AlertResolved} {
+				value := 0
+				if state == current {
+					value = 1
+				}
+				b := &strings.Builder{}
+				writePromValue(b, metric.Name)
+				fmt.Fprintf(cw, "%s_alert_state{name=\"%s\",state=%q} %d\n", ns, b.String(), state, value)
+			}
+		}
+	}
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	return cw.n, bw.Flush()
+}
+
+func (h *PrometheusHandler) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	h.WriteTo(w)
+}
+
+// Reset sets all counters back to zero.
+func (h *PrometheusHandler) Reset() {
+	h.counters.mu.Lock()
+	clear(h.counters.series)
+	h.counters.overflow = 0
+	h.counters.mu.Unlock()
+}
+
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	w.err = err
+	return n, err
+}
+
+// promName turns an attribute key into a valid label name that does not clash
+// with the level and msg labels or with the names reserved by Prometheus.
+func promName(key string) string {
+	b := []byte(key)
+	for i, c := range b {
+		if !(c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || i > 0 && '0' <= c && c <= '9') {
+			b[i] = '_'
+		}
+	}
+	if name := string(b); name != "" && name != "level" && name != "msg" && !strings.HasPrefix(name, "__") {
+		return name
+	}
+	return "attr_" + string(b)
+}
+
+// promLabelNames returns the label names of keys. Keys that end up with the
+// same name, such as http.method and http_method, get a numbered suffix.
+func promLabelNames(keys []string) []string {
+	names := make([]string, len(keys))
+	used := map[string]bool{"level": true, "msg": true}
+	for i, key := range keys {
+		name := promName(key)
+		for n := 2; used[name]; n++ {
+			name = promName(key) + "_" + strconv.Itoa(n)
+		}
+		used[name] = true
+		names[i] = name
+	}
+	return names
+}
+
+func writePromValue(b *strings.Builder, value string) {
+	for _, c := range value {
+		switch c {
+		case '\\':
+			b.WriteString(`\\`)
+		case '"':
+			b.WriteString(`\"`)
+		case '\n':
+			b.WriteString(`\n`)
+		default:
+			b.WriteRune(c)
+		}
+	}
+}
+
+// NewPrometheusHandler wraps h, counting the records that pass through it.
+func NewPrometheusHandler(h slog.Handler, opts PrometheusOptions) *PrometheusHandler {
+	return &PrometheusHandler{
+		handler: h,
+		opts:    &opts,
+		labels:  promLabelNames(opts.Labels),
+		counters: &promCounters{
+			series: make(map[string]*promSeries),
+		},
+	}
+}
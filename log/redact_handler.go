@@ -0,0 +1,291 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	defaultRedactMask = "******"
+	maxRedactDepth    = 8
+)
+
+var (
+	// DefaultRedactKeys covers the secrets of the notify package.
+	DefaultRedactKeys = []string{
+		"password", "passwd", "pwd", "token", "app_token", "secret", "api_key",
+		"access_key", "private_key", "authorization", "cookie",
+	}
+	DefaultRedactPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`\d{6,12}:[A-Za-z0-9_-]{30,}`),           // Telegram bot token
+		regexp.MustCompile(`\bAT_[A-Za-z0-9]{20,}`),                 // WxPusher app token
+		regexp.MustCompile(`\b(?:\d{4}[ -]?){3}\d{4}\b`),            // 银行卡号
+		regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9._~+/=-]{8,}`), // Authorization header
+	}
+)
+
+// RedactOptions configures RedactHandler.
+type RedactOptions struct {
+	// Keys are the attribute keys, struct field names, json tag names and map
+	// keys whose values are masked. They are compared case-insensitively with
+	// '_' and '-' ignored, so "app_token" also matches the field AppToken.
+	Keys []string
+	// Patterns are applied to the message and to string values, every match is
+	// replaced by Mask.
+	Patterns []*regexp.Regexp
+	Mask     string
+}
+
+func DefaultRedactOptions() RedactOptions {
+	return RedactOptions{
+		Keys:     DefaultRedactKeys,
+		Patterns: DefaultRedactPatterns,
+		Mask:     defaultRedactMask,
+	}
+}
+
+type redactor struct {
+	keys     map[string]struct{}
+	patterns []*regexp.Regexp
+	mask     string
+}
+
+func normalizeRedactKey(key string) string {
+	key = strings.ToLower(key)
+	key = strings.ReplaceAll(key, "_", "")
+	return strings.ReplaceAll(key, "-", "")
+}
+
+func (r *redactor) secretKey(key string) bool {
+	_, ok := r.keys[normalizeRedactKey(key)]
+	return ok
+}
+
+func (r *redactor) maskString(s string) string {
+	for _, re := range r.patterns {
+		s = re.ReplaceAllLiteralString(s, r.mask)
+	}
+	return s
+}
+
+func (r *redactor) attr(a slog.Attr, depth int) (slog.Attr, bool) {
+	if r.secretKey(a.Key) && a.Value.Kind() != slog.KindGroup {
+		return slog.String(a.Key, r.mask), true
+	}
+	v, changed := r.value(a.Value, depth)
+	if changed {
+		a.Value = v
+	}
+	return a, changed
+}
+
+func (r *redactor) attrs(attrs []slog.Attr, depth int) ([]slog.Attr, bool) {
+	var redacted []slog.Attr
+	for i, a := range attrs {
+		if a, changed := r.attr(a, depth); changed && redacted == nil {
+			redacted = make([]slog.Attr, len(attrs))
+			copy(redacted, attrs[:i])
+			redacted[i] = a
+		} else if redacted != nil {
+			redacted[i] = a
+		}
+	}
+	if redacted == nil {
+		return attrs, false
+	}
+	return redacted, true
+}
+
+// value returns the redacted form of v and whether it differs from v. Structs
+// and maps containing secrets are turned into group values.
+func (r *redactor) value(v slog.Value, depth int) (slog.Value, bool) {
+	if depth > maxRedactDepth {
+		return v, false
+	}
+	v = v.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		if s := r.maskString(v.String()); s != v.String() {
+			return slog.StringValue(s), true
+		}
+		return v, false
+	case slog.KindGroup:
+		attrs, changed := r.attrs(v.Group(), depth+1)
+		if changed {
+			return slog.GroupValue(attrs...), true
+		}
+		return v, false
+	case slog.KindAny:
+	default:
+		return v, false
+	}
+	var text string
+	switch value := v.Any().(type) {
+	case nil:
+		return v, false
+	case error:
+		text = value.Error()
+	case TerminalStringer:
+		text = value.TerminalString()
+	case fmt.Stringer:
+		text = value.String()
+	default:
+		return r.reflect(v, reflect.ValueOf(value), depth)
+	}
+	if s := r.maskString(text); s != text {
+		return slog.StringValue(s), true
+	}
+	return v, false
+}
+
+func (r *redactor) reflect(v slog.Value, rv reflect.Value, depth int) (slog.Value, bool) {
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return v, false
+		}
+		rv = rv.Elem()
+	}
+	var (
+		attrs   []slog.Attr
+		changed bool
+	)
+	add := func(key string, field reflect.Value, secret bool) {
+		if secret {
+			attrs = append(attrs, slog.String(key, r.mask))
+			changed = true
+			return
+		}
+		a, ok := r.attr(slog.Any(key, field.Interface()), depth+1)
+		attrs = append(attrs, a)
+		changed = changed || ok
+	}
+	switch rv.Kind() {
+	case reflect.Struct:
+		t := rv.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			add(name, rv.Field(i), r.secretKey(name) || r.secretKey(field.Name))
+		}
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return v, false
+		}
+		keys := rv.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].String() < keys[j].String()
+		})
+		for _, key := range keys {
+			add(key.String(), rv.MapIndex(key), r.secretKey(key.String()))
+		}
+	case reflect.Slice, reflect.Array:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			return v, false
+		}
+		// Lists stay lists, with redacted structs and maps as map[string]any.
+		list := make([]any, rv.Len())
+		for i := range list {
+			elem := rv.Index(i)
+			list[i] = elem.Interface()
+			if ev, ok := r.value(slog.AnyValue(list[i]), depth+1); ok {
+				list[i] = valueToAny(ev)
+				changed = true
+			}
+		}
+		if !changed {
+			return v, false
+		}
+		return slog.AnyValue(list), true
+	default:
+		return v, false
+	}
+	if !changed {
+		return v, false
+	}
+	return slog.GroupValue(attrs...), true
+}
+
+func valueToAny(v slog.Value) any {
+	if v.Kind() != slog.KindGroup {
+		return v.Any()
+	}
+	m := make(map[string]any)
+	for _, a := range v.Group() {
+		m[a.Key] = valueToAny(a.Value)
+	}
+	return m
+}
+
+// RedactHandler masks secrets in attributes before passing records on, so
+// that e.g. logging a notify.Email does not leak its password.
+type RedactHandler struct {
+	handler  slog.Handler
+	redactor *redactor
+}
+
+func (h *RedactHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level)
+}
+
+func (h *RedactHandler) Handle(ctx context.Context, r slog.Record) error {
+	attrs := make([]slog.Attr, 0, r.NumAttrs())
+	r.Attrs(func(attr slog.Attr) bool {
+		attrs = append(attrs, attr)
+		return true
+	})
+	attrs, _ = h.redactor.attrs(attrs, 0)
+	nr := slog.NewRecord(r.Time, r.Level, h.redactor.maskString(r.Message), r.PC)
+	nr.AddAttrs(attrs...)
+	return h.handler.Handle(ctx, nr)
+}
+
+func (h *RedactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	attrs, _ = h.redactor.attrs(attrs, 0)
+	return &RedactHandler{
+		handler:  h.handler.WithAttrs(attrs),
+		redactor: h.redactor,
+	}
+}
+
+func (h *RedactHandler) WithGroup(name string) slog.Handler {
+	return &RedactHandler{
+		handler:  h.handler.WithGroup(name),
+		redactor: h.redactor,
+	}
+}
+
+func (h *RedactHandler) handlers() []slog.Handler {
+	return []slog.Handler{h.handler}
+}
+
+func NewRedactHandler(h slog.Handler, opts RedactOptions) *RedactHandler {
+	rd := &redactor{
+		keys:     make(map[string]struct{}, len(opts.Keys)),
+		patterns: opts.Patterns,
+		mask:     opts.Mask,
+	}
+	for _, key := range opts.Keys {
+		rd.keys[normalizeRedactKey(key)] = struct{}{}
+	}
+	if rd.mask == "" {
+		rd.mask = defaultRedactMask
+	}
+	return &RedactHandler{
+		handler:  h,
+		redactor: rd,
+	}
+}
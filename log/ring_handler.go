@@ -0,0 +1,189 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RingQuery selects records from a RingHandler. Zero fields match everything.
+type RingQuery struct {
+	MinLevel slog.Leveler
+	MaxLevel slog.Leveler
+	Since    time.Time
+	Until    time.Time
+	Message  string         // 消息包含的子串
+	Attrs    map[string]any // 属性值按 fmt.Sprint 比较，分组内的键为 http.method 形式
+	Limit    int            // 只返回最新的 Limit 条
+}
+
+func (q *RingQuery) match(r *slog.Record) bool {
+	if q.MinLevel != nil && r.Level < q.MinLevel.Level() {
+		return false
+	}
+	if q.MaxLevel != nil && r.Level > q.MaxLevel.Level() {
+		return false
+	}
+	if !q.Since.IsZero() && r.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && r.Time.After(q.Until) {
+		return false
+	}
+	if q.Message != "" && !strings.Contains(r.Message, q.Message) {
+		return false
+	}
+	for key, value := range q.Attrs {
+		if !hasAttr(*r, key, fmt.Sprint(value)) {
+			return false
+		}
+	}
+	return true
+}
+
+// ring keeps the last records in a fixed slice, overwriting the oldest one
+// once it is full.
+type ring struct {
+	mu      sync.RWMutex
+	records []slog.Record
+	next    int
+	full    bool
+}
+
+func (rb *ring) add(r slog.Record) {
+	rb.mu.Lock()
+	rb.records[rb.next] = r
+	rb.next++
+	if rb.next == len(rb.records) {
+		rb.next = 0
+		rb.full = true
+	}
+	rb.mu.Unlock()
+}
+
+func (rb *ring) reset() {
+	rb.mu.Lock()
+	clear(rb.records)
+	rb.next = 0
+	rb.full = false
+	rb.mu.Unlock()
+}
+
+// each calls fn for the stored records from the oldest to the newest.
+func (rb *ring) each(fn func(r *slog.Record)) {
+	rb.mu.RLock()
+	defer rb.mu.RUnlock()
+	if rb.full {
+		for i := rb.next; i < len(rb.records); i++ {
+			fn(&rb.records[i])
+		}
+	}
+	for i := 0; i < rb.next; i++ {
+		fn(&rb.records[i])
+	}
+}
+
+// RingHandler keeps the last records in memory so they can be inspected while
+// debugging a running process. Attributes added through WithAttrs are stored
+// with every record, keys inside groups are flattened to http.method.
+type RingHandler struct {
+	ring  *ring
+	lvl   *slog.LevelVar
+	attrs []slog.Attr
+	group string
+}
+
+func (h *RingHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.lvl.Level()
+}
+
+func (h *RingHandler) Handle(_ context.Context, r slog.Record) error {
+	stored := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	stored.AddAttrs(flattenRecord(h.attrs, h.group, r)...)
+	h.ring.add(stored)
+	return nil
+}
+
+func (h *RingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &RingHandler{
+		ring:  h.ring,
+		lvl:   h.lvl,
+		attrs: appendFlatAttrs(h.attrs[:len(h.attrs):len(h.attrs)], h.group, attrs...),
+		group: h.group,
+	}
+}
+
+func (h *RingHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &RingHandler{
+		ring:  h.ring,
+		lvl:   h.lvl,
+		attrs: h.attrs,
+		group: h.group + name + ".",
+	}
+}
+
+func (h *RingHandler) SetLevel(level slog.Level) {
+	h.lvl.Set(level)
+}
+
+// Records returns copies of the stored records matching q, oldest first.
+func (h *RingHandler) Records(q RingQuery) []slog.Record {
+	var records []slog.Record
+	h.ring.each(func(r *slog.Record) {
+		if q.match(r) {
+			records = append(records, r.Clone())
+		}
+	})
+	if q.Limit > 0 && len(records) > q.Limit {
+		records = records[len(records)-q.Limit:]
+	}
+	return records
+}
+
+// Reset drops all stored records.
+func (h *RingHandler) Reset() {
+	h.ring.reset()
+}
+
+// Replay passes the records matching q to another handler.
+func (h *RingHandler) Replay(to slog.Handler, q RingQuery) error {
+	ctx := context.Background()
+	for _, r := range h.Records(q) {
+		if !to.Enabled(ctx, r.Level) {
+			continue
+		}
+		if err := to.Handle(ctx, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DumpTerminal writes the records matching q in the TerminalHandler format.
+func (h *RingHandler) DumpTerminal(w io.Writer, q RingQuery) error {
+	return h.Replay(NewTerminalHandler(w, false), q)
+}
+
+// DumpJSON writes the records matching q as JSON lines.
+func (h *RingHandler) DumpJSON(w io.Writer, q RingQuery) error {
+	return h.Replay(NewJSONHandler(w), q)
+}
+
+func NewRingHandler(size int, lvl slog.Level) *RingHandler {
+	if size <= 0 {
+		size = 1000
+	}
+	return &RingHandler{
+		ring: &ring{
+			records: make([]slog.Record, size),
+		},
+		lvl: newLevelVar(lvl),
+	}
+}
@@ -1,6 +1,7 @@
 package log
 
 import (
+	"context"
 	"log/slog"
 	"os"
 	"sync/atomic"
@@ -44,9 +45,35 @@ func Error(msg string, ctx ...any) {
 	Root().Write(slog.LevelError, msg, ctx...)
 }
 
+func Panic(msg string, ctx ...any) {
+	Root().Write(LevelPanic, msg, ctx...)
+	flushBeforeExit(Root().Handler())
+	panic(msg)
+}
+
 func Fatal(msg string, ctx ...any) {
 	Root().Write(LevelFatal, msg, ctx...)
-	os.Exit(1)
+	exit(Root().Handler(), 1)
+}
+
+func TraceCtx(ctx context.Context, msg string, attrs ...any) {
+	FromContext(ctx).WriteCtx(ctx, LevelTrace, msg, attrs...)
+}
+
+func DebugCtx(ctx context.Context, msg string, attrs ...any) {
+	FromContext(ctx).WriteCtx(ctx, slog.LevelDebug, msg, attrs...)
+}
+
+func InfoCtx(ctx context.Context, msg string, attrs ...any) {
+	FromContext(ctx).WriteCtx(ctx, slog.LevelInfo, msg, attrs...)
+}
+
+func WarnCtx(ctx context.Context, msg string, attrs ...any) {
+	FromContext(ctx).WriteCtx(ctx, slog.LevelWarn, msg, attrs...)
+}
+
+func ErrorCtx(ctx context.Context, msg string, attrs ...any) {
+	FromContext(ctx).WriteCtx(ctx, slog.LevelError, msg, attrs...)
 }
 
 func New(ctx ...any) Logger {
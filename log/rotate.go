@@ -0,0 +1,333 @@
+package log
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	backupTimeFormat = "2006-01-02T15-04-05.000"
+	compressSuffix   = ".gz"
+)
+
+type RotateSchedule int
+
+const (
+	RotateNever RotateSchedule = iota
+	RotateHourly
+	RotateDaily
+)
+
+// next returns the start of the period following the one t is in.
+func (s RotateSchedule) next(t time.Time) time.Time {
+	switch s {
+	case RotateHourly:
+		// Truncate works on the absolute time, which misses the local hour
+		// in zones with a fractional offset.
+		year, month, day := t.Date()
+		return time.Date(year, month, day, t.Hour()+1, 0, 0, 0, t.Location())
+	case RotateDaily:
+		year, month, day := t.Date()
+		return time.Date(year, month, day+1, 0, 0, 0, 0, t.Location())
+	default:
+		return time.Time{}
+	}
+}
+
+// RotatingWriter is an io.Writer that writes to Filename and moves the file
+// aside once it grows past MaxSize or the Schedule period ends. Rotated files
+// are named after the rotation time, e.g. app-2006-01-02T15-04-05.000.log.
+//
+// The writer does its own locking, so it can be shared by several handlers
+// created through WithAttrs, which each hold a separate mutex.
+type RotatingWriter struct {
+	Filename   string         `json:"filename"`
+	MaxSize    int64          `json:"max_size"`    // 单个文件最大字节数，0 表示不限制
+	Schedule   RotateSchedule `json:"schedule"`    // 按小时或按天切割
+	Compress   bool           `json:"compress"`    // 使用 gzip 压缩切割后的文件
+	MaxBackups int            `json:"max_backups"` // 最多保留的文件数量，0 表示不限制
+	MaxAge     time.Duration  `json:"max_age"`     // 最长保留时间，0 表示不限制
+
+	mu         sync.Mutex
+	file       *os.File
+	size       int64
+	nextRotate time.Time
+	signals    chan os.Signal
+	signalDone chan struct{}
+	closed     bool
+	millMu     sync.Mutex
+	wg         sync.WaitGroup
+}
+
+func NewRotatingWriter(filename string, maxSize int64, schedule RotateSchedule) *RotatingWriter {
+	return &RotatingWriter{
+		Filename: filename,
+		MaxSize:  maxSize,
+		Schedule: schedule,
+	}
+}
+
+func (w *RotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return 0, err
+		}
+	}
+	if w.shouldRotate(int64(len(p)), time.Now()) {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *RotatingWriter) shouldRotate(n int64, now time.Time) bool {
+	if !w.nextRotate.IsZero() && !now.Before(w.nextRotate) {
+		if w.size == 0 {
+			// Nothing was written in the period, the empty file is kept
+			// for the next one.
+			w.nextRotate = w.Schedule.next(now)
+			return false
+		}
+		return true
+	}
+	return w.size > 0 && w.MaxSize > 0 && w.size+n > w.MaxSize
+}
+
+// Rotate moves the current file aside and starts a new one.
+func (w *RotatingWriter) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return os.ErrClosed
+	}
+	return w.rotate()
+}
+
+// Reopen closes and reopens Filename without renaming it. It is meant for
+// external tools such as logrotate that move the file themselves.
+func (w *RotatingWriter) Reopen() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return os.ErrClosed
+	}
+	if err := w.close(); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+// Close closes the current file and waits for pending compression and
+// cleanup of rotated files. Later writes return os.ErrClosed.
+func (w *RotatingWriter) Close() error {
+	w.mu.Lock()
+	signals, done := w.signals, w.signalDone
+	w.signals, w.signalDone = nil, nil
+	w.mu.Unlock()
+	if signals != nil {
+		// The goroutine is stopped first, a signal it already received
+		// must not reopen the file after it was closed.
+		signal.Stop(signals)
+		close(signals)
+		<-done
+	}
+	w.mu.Lock()
+	w.closed = true
+	err := w.close()
+	w.mu.Unlock()
+	w.wg.Wait()
+	return err
+}
+
+func (w *RotatingWriter) open() error {
+	if err := os.MkdirAll(filepath.Dir(w.Filename), 0o755); err != nil {
+		return err
+	}
+	now := time.Now()
+	if info, err := os.Stat(w.Filename); err == nil && info.Size() > 0 && w.Schedule != RotateNever {
+		// The file was started in an earlier period, e.g. before a restart.
+		if !now.Before(w.Schedule.next(info.ModTime())) {
+			if err := w.backup(now); err != nil {
+				return err
+			}
+		}
+	}
+	file, err := os.OpenFile(w.Filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.file = file
+	w.size = info.Size()
+	w.nextRotate = w.Schedule.next(now)
+	return nil
+}
+
+func (w *RotatingWriter) close() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+func (w *RotatingWriter) rotate() error {
+	if err := w.close(); err != nil {
+		return err
+	}
+	if err := w.backup(time.Now()); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+// backup renames Filename to its backup name and starts compression and
+// cleanup in the background.
+func (w *RotatingWriter) backup(now time.Time) error {
+	name := w.backupName(now)
+	for i := 1; fileExists(name) || fileExists(name+compressSuffix); i++ {
+		// Several rotations within one millisecond.
+		name = w.backupName(now.Add(time.Duration(i) * time.Millisecond))
+	}
+	if err := os.Rename(w.Filename, name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		w.millMu.Lock()
+		defer w.millMu.Unlock()
+		if err := w.mill(); err != nil {
+			fmt.Fprintln(os.Stderr, "clean up log files error:", err)
+		}
+	}()
+	return nil
+}
+
+func (w *RotatingWriter) backupName(t time.Time) string {
+	dir, prefix, ext := w.nameParts()
+	return filepath.Join(dir, prefix+t.Format(backupTimeFormat)+ext)
+}
+
+func (w *RotatingWriter) nameParts() (dir, prefix, ext string) {
+	dir = filepath.Dir(w.Filename)
+	base := filepath.Base(w.Filename)
+	ext = filepath.Ext(base)
+	prefix = base[:len(base)-len(ext)] + "-"
+	return
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+type backupFile struct {
+	path string
+	time time.Time
+}
+
+// backups lists the rotated files belonging to this writer, newest first.
+func (w *RotatingWriter) backups() ([]backupFile, error) {
+	dir, prefix, ext := w.nameParts()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []backupFile
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		stamp := strings.TrimPrefix(name, prefix)
+		stamp = strings.TrimSuffix(stamp, compressSuffix)
+		if !strings.HasSuffix(stamp, ext) {
+			continue
+		}
+		t, err := time.ParseInLocation(backupTimeFormat, strings.TrimSuffix(stamp, ext), time.Local)
+		if err != nil {
+			continue
+		}
+		files = append(files, backupFile{path: filepath.Join(dir, name), time: t})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].time.After(files[j].time)
+	})
+	return files, nil
+}
+
+// mill removes the backups exceeding MaxBackups or MaxAge and compresses the
+// remaining ones if Compress is set.
+func (w *RotatingWriter) mill() error {
+	files, err := w.backups()
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-w.MaxAge)
+	for i, file := range files {
+		if (w.MaxBackups > 0 && i >= w.MaxBackups) || (w.MaxAge > 0 && file.time.Before(cutoff)) {
+			if err := os.Remove(file.path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		if w.Compress && !strings.HasSuffix(file.path, compressSuffix) {
+			if err := compressFile(file.path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func compressFile(name string) (err error) {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(name+compressSuffix, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			dst.Close()
+			os.Remove(name + compressSuffix)
+		}
+	}()
+	gz := gzip.NewWriter(dst)
+	if _, err = io.Copy(gz, src); err != nil {
+		return err
+	}
+	if err = gz.Close(); err != nil {
+		return err
+	}
+	if err = dst.Close(); err != nil {
+		return err
+	}
+	src.Close()
+	return os.Remove(name)
+}
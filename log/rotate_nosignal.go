@@ -0,0 +1,6 @@
+//go:build js || wasip1 || windows
+
+package log
+
+// ReopenOnSignal does nothing, there is no SIGHUP on this platform.
+func (w *RotatingWriter) ReopenOnSignal() {}
@@ -0,0 +1,32 @@
+//go:build !js && !wasip1 && !windows
+
+package log
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// ReopenOnSignal calls Reopen every time the process receives SIGHUP, until
+// Close is called.
+func (w *RotatingWriter) ReopenOnSignal() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.signals != nil || w.closed {
+		return
+	}
+	w.signals = make(chan os.Signal, 1)
+	w.signalDone = make(chan struct{})
+	signal.Notify(w.signals, syscall.SIGHUP)
+	go func(signals chan os.Signal, done chan struct{}) {
+		defer close(done)
+		for range signals {
+			if err := w.Reopen(); err != nil && !errors.Is(err, os.ErrClosed) {
+				fmt.Fprintln(os.Stderr, "reopen log file error:", err)
+			}
+		}
+	}(w.signals, w.signalDone)
+}
@@ -0,0 +1,168 @@
+package log
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+type samplingKey struct {
+	level slog.Level
+	msg   string
+}
+
+type samplingCounter struct {
+	handler    slog.Handler // 第一次出现时的 handler，汇总日志带上它的属性
+	count      uint64
+	suppressed uint64
+}
+
+// samplingState counts the records of each level and message within the
+// current interval, whichever logger wrote them.
+type samplingState struct {
+	interval   time.Duration
+	first      uint64
+	thereafter uint64
+
+	mu       sync.Mutex
+	counters map[samplingKey]*samplingCounter
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func (s *samplingState) sample(h slog.Handler, r *slog.Record) bool {
+	key := samplingKey{level: r.Level, msg: r.Message}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.counters[key]
+	if !ok {
+		c = &samplingCounter{handler: h}
+		s.counters[key] = c
+	}
+	c.count++
+	if c.count <= s.first || (s.thereafter > 0 && (c.count-s.first)%s.thereafter == 0) {
+		return true
+	}
+	c.suppressed++
+	return false
+}
+
+func (s *samplingState) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.summarize()
+		case <-s.stop:
+			s.summarize()
+			return
+		}
+	}
+}
+
+// summarize ends the current window: it logs one record for every message
+// that had lines suppressed and resets all counters.
+func (s *samplingState) summarize() {
+	s.mu.Lock()
+	counters := s.counters
+	s.counters = make(map[samplingKey]*samplingCounter, len(counters))
+	s.mu.Unlock()
+
+	ctx := context.Background()
+	for key, c := range counters {
+		if c.suppressed == 0 || !c.handler.Enabled(ctx, key.level) {
+			continue
+		}
+		r := slog.NewRecord(time.Now(), key.level, "Suppressed repeated log records", 0)
+		r.AddAttrs(
+			slog.String("message", key.msg),
+			slog.Uint64("suppressed", c.suppressed),
+			slog.Uint64("total", c.count),
+			slog.Duration("window", s.interval),
+		)
+		c.handler.Handle(ctx, r)
+	}
+}
+
+// SamplingHandler limits the volume of repeated records. Within every interval
+// it passes the first N records with the same level and message, and after
+// that only every Mth one. At the end of the interval a summary record reports
+// how many records were suppressed.
+type SamplingHandler struct {
+	handler slog.Handler
+	state   *samplingState
+}
+
+func (s *SamplingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return s.handler.Enabled(ctx, level)
+}
+
+func (s *SamplingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if !s.state.sample(s.handler, &r) {
+		return nil
+	}
+	return s.handler.Handle(ctx, r)
+}
+
+func (s *SamplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &SamplingHandler{
+		handler: s.handler.WithAttrs(attrs),
+		state:   s.state,
+	}
+}
+
+func (s *SamplingHandler) WithGroup(name string) slog.Handler {
+	return &SamplingHandler{
+		handler: s.handler.WithGroup(name),
+		state:   s.state,
+	}
+}
+
+func (s *SamplingHandler) handlers() []slog.Handler {
+	return []slog.Handler{s.handler}
+}
+
+// Flush ends the current window early and writes its summary, so that
+// FlushHandler does not lose the suppressed counts before an exit.
+func (s *SamplingHandler) Flush() error {
+	s.state.summarize()
+	return nil
+}
+
+// Close stops the window timer and writes the summary of the current window.
+func (s *SamplingHandler) Close() error {
+	s.state.mu.Lock()
+	select {
+	case <-s.state.stop:
+	default:
+		close(s.state.stop)
+	}
+	s.state.mu.Unlock()
+	<-s.state.done
+	return nil
+}
+
+// NewSamplingHandler passes the first records with the same level and message
+// in every interval, then every thereafter-th one. A thereafter of 0 drops all
+// records after the first ones.
+func NewSamplingHandler(h slog.Handler, interval time.Duration, first, thereafter int) *SamplingHandler {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	state := &samplingState{
+		interval:   interval,
+		first:      uint64(max(first, 0)),
+		thereafter: uint64(max(thereafter, 0)),
+		counters:   make(map[samplingKey]*samplingCounter),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go state.run()
+	return &SamplingHandler{
+		handler: h,
+		state:   state,
+	}
+}
@@ -0,0 +1,591 @@
+package log
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ShipFormat is the payload format of a ShipperHandler.
+type ShipFormat int
+
+const (
+	ShipLoki          ShipFormat = iota // POST /loki/api/v1/push
+	ShipElasticsearch                   // POST /_bulk
+)
+
+// HTTPClient sends the requests of a ShipperHandler, *http.Client and
+// utils.PollingClient implement it.
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// ShipperOptions configures a ShipperHandler.
+type ShipperOptions struct {
+	URL           string
+	Format        ShipFormat
+	Client        HTTPClient        // 为空时使用 http.DefaultClient
+	Header        http.Header       // 附加的请求头，例如 Authorization
+	Level         slog.Level        // 最低日志级别
+	Labels        map[string]string // Loki 的 stream 标签，level 标签由日志级别决定，同名的标签被忽略
+	Index         string            // Elasticsearch 的索引，默认 logs
+	Gzip          bool              // 压缩请求内容
+	BatchSize     int               // 每批最多的日志数，默认 500
+	Interval      time.Duration     // 最长的发送间隔，默认 5s
+	QueueSize     int               // 等待发送的日志数，队列满时丢弃，默认 10000
+	Timeout       time.Duration     // 单次请求超时，默认 10s
+	Retries       int               // 失败后的重试次数，默认 3，小于 0 时不重试
+	Backoff       time.Duration     // 第一次重试前的等待时间，之后每次翻倍，默认 1s
+	MaxBackoff    time.Duration     // 默认 30s
+	SpoolDir      string            // 重试失败的请求保存在此目录，恢复后重新发送，为空时丢弃
+	MaxSpoolFiles int               // 最多保存的请求数，超过时删除最早的，默认 1000
+}
+
+// ShipperStats counts the batches and records handled by a ShipperHandler.
+type ShipperStats struct {
+	Sent     uint64 `json:"sent"`     // 发送成功的批次
+	Failed   uint64 `json:"failed"`   // 被丢弃的批次
+	Spooled  uint64 `json:"spooled"`  // 保存到 SpoolDir 的批次
+	Dropped  uint64 `json:"dropped"`  // 队列已满被丢弃的日志
+	Rejected uint64 `json:"rejected"` // 被 Elasticsearch 拒绝且不能重试的日志
+}
+
+type shipEntry struct {
+	time  time.Time
+	level slog.Level
+	line  []byte
+}
+
+// shipper collects the entries into batches on a background goroutine and
+// sends each batch once it is full or Interval has passed.
+type shipper struct {
+	opts    *ShipperOptions
+	entries chan shipEntry
+	flush   chan chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+	mu      sync.RWMutex
+	closed  bool
+
+	sent, failed, spooled, dropped, rejected atomic.Uint64
+}
+
+func (s *shipper) push(e shipEntry) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		s.dropped.Add(1)
+		return
+	}
+	select {
+	case s.entries <- e:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+func (s *shipper) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.opts.Interval)
+	defer ticker.Stop()
+	var batch []shipEntry
+	for {
+		select {
+		case e := <-s.entries:
+			batch = append(batch, e)
+			if len(batch) >= s.opts.BatchSize {
+				s.deliver(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			s.replay()
+			s.deliver(batch)
+			batch = nil
+		case flushed := <-s.flush:
+			s.drain(batch)
+			batch = nil
+			close(flushed)
+		case <-s.stop:
+			s.drain(batch)
+			return
+		}
+	}
+}
+
+// drain sends batch and everything queued, after the spooled requests.
+func (s *shipper) drain(batch []shipEntry) {
+	s.replay()
+	for {
+		select {
+		case e := <-s.entries:
+			batch = append(batch, e)
+			if len(batch) >= s.opts.BatchSize {
+				s.deliver(batch)
+				batch = nil
+			}
+		default:
+			s.deliver(batch)
+			return
+		}
+	}
+}
+
+func (s *shipper) deliver(batch []shipEntry) {
+	if len(batch) == 0 {
+		return
+	}
+	body, err := s.encode(batch)
+	if err != nil {
+		s.failed.Add(1)
+		fmt.Fprintln(os.Stderr, "encode log batch error:", err)
+		return
+	}
+	// While older requests wait in the spool the endpoint is down, and
+	// they must be sent first anyway.
+	if s.spoolFiles() > 0 {
+		s.spool(body)
+		return
+	}
+	backoff := s.opts.Backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := s.post(body, s.opts.Gzip)
+		if err == nil {
+			s.sent.Add(1)
+			return
+		}
+		if retry == nil {
+			s.failed.Add(1)
+			fmt.Fprintln(os.Stderr, "ship logs error:", err)
+			return
+		}
+		body = retry
+		// Once Close was called the remaining retries are skipped, the batch
+		// goes to the spool right away.
+		if attempt >= s.opts.Retries || !s.wait(backoff) {
+			if s.opts.SpoolDir != "" {
+				s.spool(body)
+				return
+			}
+			s.failed.Add(1)
+			fmt.Fprintln(os.Stderr, "ship logs error:", err)
+			return
+		}
+		backoff = min(backoff*2, s.opts.MaxBackoff)
+	}
+}
+
+// wait sleeps for d and reports whether the shipper is still running.
+func (s *shipper) wait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-s.stop:
+		return false
+	}
+}
+
+func (s *shipper) encode(batch []shipEntry) ([]byte, error) {
+	body := &bytes.Buffer{}
+	var w io.Writer = body
+	var zw *gzip.Writer
+	if s.opts.Gzip {
+		zw = gzip.NewWriter(body)
+		w = zw
+	}
+	if s.opts.Format == ShipElasticsearch {
+		action := appendJSONString([]byte(`{"index":{"_index":`), s.opts.Index)
+		action = append(action, "}}\n"...)
+		for _, e := range batch {
+			w.Write(action)
+			w.Write(e.line)
+			w.Write([]byte{'\n'})
+		}
+	} else {
+		w.Write(s.encodeLoki(batch))
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return body.Bytes(), nil
+}
+
+// encodeLoki writes one stream per level:
+//
+//	{"streams":[{"stream":{"app":"api","level":"info"},"values":[["<unix ns>","<line>"]]}]}
+func (s *shipper) encodeLoki(batch []shipEntry) []byte {
+	var levels []slog.Level
+	streams := make(map[slog.Level][]shipEntry)
+	for _, e := range batch {
+		if _, ok := streams[e.level]; !ok {
+			levels = append(levels, e.level)
+		}
+		streams[e.level] = append(streams[e.level], e)
+	}
+	keys := make([]string, 0, len(s.opts.Labels))
+	for key := range s.opts.Labels {
+		if key != "level" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	buf := []byte(`{"streams":[`)
+	for i, level := range levels {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, `{"stream":{`...)
+		for _, key := range keys {
+			buf = appendJSONString(buf, key)
+			buf = append(buf, ':')
+			buf = appendJSONString(buf, s.opts.Labels[key])
+			buf = append(buf, ',')
+		}
+		buf = append(buf, `"level":`...)
+		buf = appendJSONString(buf, LevelString(level))
+		buf = append(buf, `},"values":[`...)
+		for j, e := range streams[level] {
+			if j > 0 {
+				buf = append(buf, ',')
+			}
+			buf = append(buf, `["`...)
+			buf = strconv.AppendInt(buf, e.time.UnixNano(), 10)
+			buf = append(buf, `",`...)
+			buf = appendJSONString(buf, string(e.line))
+			buf = append(buf, ']')
+		}
+		buf = append(buf, "]}"...)
+	}
+	return append(buf, "]}"...)
+}
+
+// post sends body once and returns the request to send again when it failed
+// with a server error or on a failed connection, other errors would fail
+// again. For Elasticsearch only the documents rejected with a retryable
+// status are sent again.
+func (s *shipper) post(body []byte, gzipped bool) (retry []byte, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.opts.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range s.opts.Header {
+		req.Header[key] = values
+	}
+	if s.opts.Format == ShipElasticsearch {
+		req.Header.Set("Content-Type", "application/x-ndjson")
+	} else {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if gzipped {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	resp, err := s.opts.Client.Do(req)
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 300 && s.opts.Format == ShipElasticsearch {
+		return s.bulkResult(resp.Body, body, gzipped)
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	switch {
+	case resp.StatusCode < 300:
+		return nil, nil
+	case retryableStatus(resp.StatusCode):
+		return body, fmt.Errorf("%s: %s", resp.Status, msg)
+	default:
+		return nil, fmt.Errorf("%s: %s", resp.Status, msg)
+	}
+}
+
+func retryableStatus(code int) bool {
+	return code >= 500 || code == http.StatusTooManyRequests
+}
+
+// bulkResult reads the response of a _bulk request, which succeeds even if
+// some documents were rejected. Documents rejected for good are counted and
+// reported, the others are returned as a new request.
+func (s *shipper) bulkResult(r io.Reader, body []byte, gzipped bool) (retry []byte, err error) {
+	var result struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int             `json:"status"`
+			Error  json.RawMessage `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(r).Decode(&result); err != nil || !result.Errors {
+		return nil, nil
+	}
+	var (
+		failed []int
+		reason json.RawMessage
+	)
+	for i, item := range result.Items {
+		for _, action := range item {
+			switch {
+			case action.Status < 300:
+			case retryableStatus(action.Status):
+				failed = append(failed, i)
+				reason = action.Error
+			default:
+				s.rejected.Add(1)
+				fmt.Fprintf(os.Stderr, "elasticsearch rejected log: %d %s\n", action.Status, action.Error)
+			}
+		}
+	}
+	if len(failed) == 0 {
+		return nil, nil
+	}
+	if retry, err = bulkSubset(body, gzipped, failed); err != nil {
+		return nil, err
+	}
+	return retry, fmt.Errorf("elasticsearch failed %d of %d logs: %s", len(failed), len(result.Items), reason)
+}
+
+// bulkSubset returns the action and document lines of the given documents of
+// a _bulk request.
+func bulkSubset(body []byte, gzipped bool, docs []int) ([]byte, error) {
+	if gzipped {
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if body, err = io.ReadAll(zr); err != nil {
+			return nil, err
+		}
+	}
+	lines := bytes.SplitAfter(body, []byte{'\n'})
+	subset := &bytes.Buffer{}
+	var w io.Writer = subset
+	var zw *gzip.Writer
+	if gzipped {
+		zw = gzip.NewWriter(subset)
+		w = zw
+	}
+	for _, i := range docs {
+		if 2*i+1 < len(lines) {
+			w.Write(lines[2*i])
+			w.Write(lines[2*i+1])
+		}
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return subset.Bytes(), nil
+}
+
+// spoolNames returns the spooled requests, oldest first.
+func (s *shipper) spoolNames() []string {
+	if s.opts.SpoolDir == "" {
+		return nil
+	}
+	entries, err := os.ReadDir(s.opts.SpoolDir)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".batch") || strings.HasSuffix(entry.Name(), ".batch.gz") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *shipper) spoolFiles() int {
+	return len(s.spoolNames())
+}
+
+func (s *shipper) spool(body []byte) {
+	if err := os.MkdirAll(s.opts.SpoolDir, 0755); err != nil {
+		s.failed.Add(1)
+		fmt.Fprintln(os.Stderr, "spool logs error:", err)
+		return
+	}
+	name := fmt.Sprintf("%020d.batch", time.Now().UnixNano())
+	if s.opts.Gzip {
+		name += ".gz"
+	}
+	if err := os.WriteFile(filepath.Join(s.opts.SpoolDir, name), body, 0644); err != nil {
+		s.failed.Add(1)
+		fmt.Fprintln(os.Stderr, "spool logs error:", err)
+		return
+	}
+	s.spooled.Add(1)
+	names := s.spoolNames()
+	for i := 0; i < len(names)-s.opts.MaxSpoolFiles; i++ {
+		os.Remove(filepath.Join(s.opts.SpoolDir, names[i]))
+		s.failed.Add(1)
+	}
+}
+
+// replay sends the spooled requests until one of them fails.
+func (s *shipper) replay() {
+	for _, name := range s.spoolNames() {
+		filename := filepath.Join(s.opts.SpoolDir, name)
+		body, err := os.ReadFile(filename)
+		if err != nil {
+			continue
+		}
+		retry, err := s.post(body, strings.HasSuffix(name, ".gz"))
+		if retry != nil {
+			if !bytes.Equal(retry, body) {
+				os.WriteFile(filename, retry, 0644)
+			}
+			return
+		}
+		if err == nil {
+			s.sent.Add(1)
+		} else {
+			s.failed.Add(1)
+			fmt.Fprintln(os.Stderr, "ship spooled logs error:", err)
+		}
+		os.Remove(filename)
+	}
+}
+
+// ShipperHandler sends records as JSON lines in batches to Loki or
+// Elasticsearch. Batches that cannot be delivered after the retries are kept
+// in SpoolDir and sent again once the endpoint is back, also by the next
+// process using the same directory.
+type ShipperHandler struct {
+	json    *JSONHandler
+	shipper *shipper
+}
+
+func (h *ShipperHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.json.Enabled(ctx, level)
+}
+
+func (h *ShipperHandler) Handle(_ context.Context, r slog.Record) error {
+	line := h.json.format(nil, r)
+	h.shipper.push(shipEntry{
+		time:  r.Time,
+		level: r.Level,
+		line:  line[:len(line)-1], // 去掉换行
+	})
+	return nil
+}
+
+func (h *ShipperHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &ShipperHandler{
+		json:    h.json.WithAttrs(attrs).(*JSONHandler),
+		shipper: h.shipper,
+	}
+}
+
+func (h *ShipperHandler) WithGroup(name string) slog.Handler {
+	return &ShipperHandler{
+		json:    h.json.WithGroup(name).(*JSONHandler),
+		shipper: h.shipper,
+	}
+}
+
+func (h *ShipperHandler) SetLevel(level slog.Level) {
+	h.json.SetLevel(level)
+}
+
+func (h *ShipperHandler) Stats() ShipperStats {
+	return ShipperStats{
+		Sent:     h.shipper.sent.Load(),
+		Failed:   h.shipper.failed.Load(),
+		Spooled:  h.shipper.spooled.Load(),
+		Dropped:  h.shipper.dropped.Load(),
+		Rejected: h.shipper.rejected.Load(),
+	}
+}
+
+// Flush sends the spooled requests and the queued records and waits for the
+// result.
+func (h *ShipperHandler) Flush() error {
+	flushed := make(chan struct{})
+	select {
+	case h.shipper.flush <- flushed:
+		<-flushed
+	case <-h.shipper.done:
+	}
+	return nil
+}
+
+// Close sends the queued records and stops the background goroutine, records
+// logged after Close are dropped.
+func (h *ShipperHandler) Close() error {
+	s := h.shipper
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.stop)
+	}
+	s.mu.Unlock()
+	<-s.done
+	return nil
+}
+
+func NewShipperHandler(opts ShipperOptions) *ShipperHandler {
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	if opts.Index == "" {
+		opts.Index = "logs"
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 500
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = 5 * time.Second
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 10000
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.Retries < 0 {
+		opts.Retries = 0
+	} else if opts.Retries == 0 {
+		opts.Retries = 3
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = time.Second
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 30 * time.Second
+	}
+	if opts.MaxSpoolFiles <= 0 {
+		opts.MaxSpoolFiles = 1000
+	}
+	s := &shipper{
+		opts:    &opts,
+		entries: make(chan shipEntry, opts.QueueSize),
+		flush:   make(chan chan struct{}),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+	return &ShipperHandler{
+		json:    NewJSONHandlerWithLevel(nil, opts.Level),
+		shipper: s,
+	}
+}
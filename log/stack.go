@@ -0,0 +1,122 @@
+package log
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// StackKey is the key of the stack added by StackHandler.
+const StackKey = "stack"
+
+const maxStackDepth = 64
+
+// Stack holds the program counters of a goroutine stack, innermost first.
+// TerminalHandler writes it below the record, JSONHandler as an array of
+// frames.
+type Stack []uintptr
+
+// Frames resolves the program counters to functions and source locations.
+func (s Stack) Frames() []runtime.Frame {
+	if len(s) == 0 {
+		return nil
+	}
+	var frames []runtime.Frame
+	iter := runtime.CallersFrames(s)
+	for {
+		frame, more := iter.Next()
+		frames = append(frames, frame)
+		if !more {
+			return frames
+		}
+	}
+}
+
+// String formats the stack like a panic does.
+func (s Stack) String() string {
+	b := &strings.Builder{}
+	for _, frame := range s.Frames() {
+		b.WriteString(frame.Function)
+		b.WriteString("\n\t")
+		b.WriteString(frame.File)
+		b.WriteByte(':')
+		b.WriteString(strconv.Itoa(frame.Line))
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+type stackFrame struct {
+	Func string `json:"func"`
+	File string `json:"file"`
+	Line int    `json:"line"`
+}
+
+func (s Stack) MarshalJSON() ([]byte, error) {
+	frames := make([]stackFrame, 0, len(s))
+	for _, frame := range s.Frames() {
+		frames = append(frames, stackFrame{Func: frame.Function, File: frame.File, Line: frame.Line})
+	}
+	return json.Marshal(frames)
+}
+
+// StackHandler adds the stack of the logging goroutine to records at or above
+// its level. It must run on that goroutine, so it has to be placed in front of
+// an AsyncHandler rather than behind it.
+type StackHandler struct {
+	handler slog.Handler
+	lvl     *slog.LevelVar
+}
+
+func (h *StackHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level)
+}
+
+func (h *StackHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= h.lvl.Level() {
+		pcs := make([]uintptr, maxStackDepth)
+		pcs = pcs[:runtime.Callers(2, pcs)]
+		// Skip the frames of slog and of the logger, the stack starts where
+		// the record was logged.
+		if i := slices.Index(pcs, r.PC); i >= 0 {
+			pcs = pcs[i:]
+		}
+		r = r.Clone()
+		r.AddAttrs(slog.Any(StackKey, Stack(pcs)))
+	}
+	return h.handler.Handle(ctx, r)
+}
+
+func (h *StackHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &StackHandler{
+		handler: h.handler.WithAttrs(attrs),
+		lvl:     h.lvl,
+	}
+}
+
+func (h *StackHandler) WithGroup(name string) slog.Handler {
+	return &StackHandler{
+		handler: h.handler.WithGroup(name),
+		lvl:     h.lvl,
+	}
+}
+
+func (h *StackHandler) handlers() []slog.Handler {
+	return []slog.Handler{h.handler}
+}
+
+func (h *StackHandler) SetLevel(level slog.Level) {
+	h.lvl.Set(level)
+}
+
+// NewStackHandler wraps h, adding stacks to the records at level and above.
+func NewStackHandler(h slog.Handler, level slog.Level) *StackHandler {
+	return &StackHandler{
+		handler: h,
+		lvl:     newLevelVar(level),
+	}
+}
@@ -0,0 +1,377 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// SyslogFormat is the message format written by a SyslogHandler.
+type SyslogFormat int
+
+const (
+	RFC5424 SyslogFormat = iota
+	RFC3164
+)
+
+// Facility is the syslog facility of the messages.
+type Facility int
+
+const (
+	FacilityKern   Facility = 0
+	FacilityUser   Facility = 1
+	FacilityDaemon Facility = 3
+	FacilityAuth   Facility = 4
+	FacilityLocal0 Facility = 16
+	FacilityLocal1 Facility = 17
+	FacilityLocal2 Facility = 18
+	FacilityLocal3 Facility = 19
+	FacilityLocal4 Facility = 20
+	FacilityLocal5 Facility = 21
+	FacilityLocal6 Facility = 22
+	FacilityLocal7 Facility = 23
+)
+
+// SyslogOptions configures a SyslogHandler.
+type SyslogOptions struct {
+	Network  string // udp、tcp、unix 或 unixgram
+	Addr     string // 地址或 socket 路径，例如 localhost:514、/dev/log
+	Format   SyslogFormat
+	Facility *Facility     // 为空时使用 FacilityUser
+	AppName  string        // 默认为程序名
+	Hostname string        // 默认为 os.Hostname
+	Level    slog.Level    // 最低日志级别
+	SDID     string        // RFC 5424 结构化数据的 ID，默认 attrs@32473
+	Timeout  time.Duration // 连接和写入超时，默认 5s
+	MaxSize  int           // udp 和 unixgram 消息的最大字节数，超出部分被截断，默认 65507
+}
+
+// SyslogSeverity maps a level to a syslog severity: fatal and panic are
+// critical, trace is debug.
+func SyslogSeverity(level slog.Level) int {
+	switch {
+	case level >= LevelPanic:
+		return 2
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 4
+	case level >= slog.LevelInfo:
+		return 6
+	default:
+		return 7
+	}
+}
+
+const (
+	syslogMinBackoff = 100 * time.Millisecond
+	syslogMaxBackoff = 30 * time.Second
+)
+
+// syslogConn guards the connection, which is dialed by the first write and
+// dropped after a failed one. After a failed dial records are dropped until
+// the backoff passed.
+type syslogConn struct {
+	mu      sync.Mutex
+	conn    net.Conn
+	dialing chan struct{} // 正在连接时不为空，连接结束后关闭
+	retryAt time.Time     // 连接失败后，在此之前不再重试
+	backoff time.Duration
+	err     error // 最近一次连接的错误
+}
+
+// connect returns with c.mu held and c.conn open, or with an error and
+// without the lock. The dial runs without the lock, writers arriving
+// meanwhile wait for its outcome.
+func (c *syslogConn) connect(opts *SyslogOptions) error {
+	c.mu.Lock()
+	for c.conn == nil && c.dialing != nil {
+		dialing := c.dialing
+		c.mu.Unlock()
+		<-dialing
+		c.mu.Lock()
+	}
+	if c.conn != nil {
+		return nil
+	}
+	if time.Now().Before(c.retryAt) {
+		err := c.err
+		c.mu.Unlock()
+		return err
+	}
+	dialing := make(chan struct{})
+	c.dialing = dialing
+	c.mu.Unlock()
+	conn, err := net.DialTimeout(opts.Network, opts.Addr, opts.Timeout)
+	c.mu.Lock()
+	c.dialing = nil
+	close(dialing)
+	if err != nil {
+		c.backoff = min(max(c.backoff*2, syslogMinBackoff), syslogMaxBackoff)
+		c.retryAt = time.Now().Add(c.backoff)
+		c.err = err
+		c.mu.Unlock()
+		return err
+	}
+	c.backoff = 0
+	c.conn = conn
+	return nil
+}
+
+// SyslogHandler sends records to a syslog server. The connection is opened on
+// the first record and reopened after a failed write. While the server cannot
+// be reached, records fail without dialing until a backoff of up to 30s passed.
+type SyslogHandler struct {
+	opts  *SyslogOptions
+	lvl   *slog.LevelVar
+	conn  *syslogConn
+	pid   string
+	attrs []slog.Attr
+	group string
+}
+
+func (h *SyslogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.lvl.Level()
+}
+
+func (h *SyslogHandler) Handle(_ context.Context, r slog.Record) error {
+	attrs := flattenRecord(h.attrs, h.group, r)
+	var msg []byte
+	if h.opts.Format == RFC3164 {
+		msg = h.format3164(r, attrs)
+	} else {
+		msg = h.format5424(r, attrs)
+	}
+	return h.write(msg)
+}
+
+func (h *SyslogHandler) priority(level slog.Level) string {
+	return "<" + strconv.Itoa(int(*h.opts.Facility)*8+SyslogSeverity(level)) + ">"
+}
+
+// format5424 writes <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD MSG.
+func (h *SyslogHandler) format5424(r slog.Record, attrs []slog.Attr) []byte {
+	b := &bytes.Buffer{}
+	b.WriteString(h.priority(r.Level))
+	b.WriteString("1 ")
+	b.WriteString(r.Time.Format("2006-01-02T15:04:05.000000Z07:00"))
+	b.WriteByte(' ')
+	b.WriteString(syslogHeaderField(h.opts.Hostname, 255))
+	b.WriteByte(' ')
+	b.WriteString(syslogHeaderField(h.opts.AppName, 48))
+	b.WriteByte(' ')
+	b.WriteString(h.pid)
+	b.WriteString(" - ")
+	if len(attrs) == 0 {
+		b.WriteByte('-')
+	} else {
+		b.WriteByte('[')
+		b.WriteString(h.opts.SDID)
+		for _, attr := range attrs {
+			b.WriteByte(' ')
+			b.WriteString(syslogParamName(attr.Key))
+			b.WriteString(`="`)
+			writeSyslogParamValue(b, attr.Value)
+			b.WriteByte('"')
+		}
+		b.WriteByte(']')
+	}
+	if r.Message != "" {
+		b.WriteByte(' ')
+		b.WriteString(r.Message)
+	}
+	return b.Bytes()
+}
+
+// format3164 writes <PRI>Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG key=value.
+func (h *SyslogHandler) format3164(r slog.Record, attrs []slog.Attr) []byte {
+	b := &bytes.Buffer{}
+	b.WriteString(h.priority(r.Level))
+	b.WriteString(r.Time.Format(time.Stamp))
+	b.WriteByte(' ')
+	b.WriteString(syslogHeaderField(h.opts.Hostname, 255))
+	b.WriteByte(' ')
+	b.WriteString(syslogHeaderField(h.opts.AppName, 32))
+	b.WriteByte('[')
+	b.WriteString(h.pid)
+	b.WriteString("]: ")
+	// A stream delimits the messages with newlines, so they cannot be part of
+	// a message.
+	msg := escapeMessage(r.Message)
+	if strings.ContainsAny(msg, "\r\n") {
+		msg = strconv.Quote(msg)
+	}
+	b.WriteString(msg)
+	for _, attr := range attrs {
+		b.WriteByte(' ')
+		b.Write(appendEscapeString(nil, attr.Key))
+		b.WriteByte('=')
+		b.Write(FormatSlogValue(attr.Value, nil))
+	}
+	return b.Bytes()
+}
+
+// write sends msg, reconnecting once if the connection failed.
+func (h *SyslogHandler) write(msg []byte) error {
+	msg = h.frame(msg)
+	c := h.conn
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if err = c.connect(h.opts); err != nil {
+			return err
+		}
+		c.conn.SetWriteDeadline(time.Now().Add(h.opts.Timeout))
+		if _, err = c.conn.Write(msg); err != nil {
+			c.conn.Close()
+			c.conn = nil
+		}
+		c.mu.Unlock()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// frame delimits messages on stream sockets, RFC 5424 messages with octet
+// counting (RFC 6587), RFC 3164 messages with a newline. Datagrams are cut
+// to MaxSize.
+func (h *SyslogHandler) frame(msg []byte) []byte {
+	switch h.opts.Network {
+	case "udp", "udp4", "udp6", "unixgram":
+		if len(msg) <= h.opts.MaxSize {
+			return msg
+		}
+		n := h.opts.MaxSize
+		for n > 0 && !utf8.RuneStart(msg[n]) {
+			n--
+		}
+		return msg[:n]
+	}
+	if h.opts.Format == RFC3164 {
+		return append(msg, '\n')
+	}
+	return append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+}
+
+func (h *SyslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &SyslogHandler{
+		opts:  h.opts,
+		lvl:   h.lvl,
+		conn:  h.conn,
+		pid:   h.pid,
+		attrs: appendFlatAttrs(h.attrs[:len(h.attrs):len(h.attrs)], h.group, attrs...),
+		group: h.group,
+	}
+}
+
+func (h *SyslogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &SyslogHandler{
+		opts:  h.opts,
+		lvl:   h.lvl,
+		conn:  h.conn,
+		pid:   h.pid,
+		attrs: h.attrs,
+		group: h.group + name + ".",
+	}
+}
+
+func (h *SyslogHandler) SetLevel(level slog.Level) {
+	h.lvl.Set(level)
+}
+
+func (h *SyslogHandler) Level() slog.Level {
+	return h.lvl.Level()
+}
+
+// Close closes the connection, the next record opens a new one.
+func (h *SyslogHandler) Close() error {
+	h.conn.mu.Lock()
+	defer h.conn.mu.Unlock()
+	if h.conn.conn == nil {
+		return nil
+	}
+	err := h.conn.conn.Close()
+	h.conn.conn = nil
+	return err
+}
+
+// syslogHeaderField replaces the characters not allowed in a header field.
+func syslogHeaderField(s string, maxLen int) string {
+	if s == "" {
+		return "-"
+	}
+	b := []byte(s)
+	for i, c := range b {
+		if c <= ' ' || c >= 127 {
+			b[i] = '_'
+		}
+	}
+	if len(b) > maxLen {
+		b = b[:maxLen]
+	}
+	return string(b)
+}
+
+// syslogParamName replaces the characters not allowed in an SD-NAME.
+func syslogParamName(key string) string {
+	b := []byte(syslogHeaderField(key, 32))
+	for i, c := range b {
+		if c == '=' || c == ']' || c == '"' {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+func writeSyslogParamValue(b *bytes.Buffer, v slog.Value) {
+	for _, c := range v.Resolve().String() {
+		switch c {
+		case '"', '\\', ']':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+}
+
+// NewSyslogHandler returns a handler sending to the server at opts.Addr.
+func NewSyslogHandler(opts SyslogOptions) *SyslogHandler {
+	facility := FacilityUser
+	if opts.Facility != nil {
+		facility = *opts.Facility
+	}
+	opts.Facility = &facility
+	if opts.AppName == "" {
+		opts.AppName = filepath.Base(os.Args[0])
+	}
+	if opts.Hostname == "" {
+		opts.Hostname, _ = os.Hostname()
+	}
+	if opts.SDID == "" {
+		opts.SDID = "attrs@32473"
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	if opts.MaxSize <= 0 {
+		// The largest UDP payload over IPv4.
+		opts.MaxSize = 65507
+	}
+	return &SyslogHandler{
+		opts: &opts,
+		lvl:  newLevelVar(opts.Level),
+		conn: &syslogConn{},
+		pid:  strconv.Itoa(os.Getpid()),
+	}
+}
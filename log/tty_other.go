@@ -0,0 +1,7 @@
+//go:build !linux && !aix && !solaris && !zos && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd && !windows
+
+package log
+
+func isTerminal(fd uintptr) bool {
+	return false
+}
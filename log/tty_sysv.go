@@ -0,0 +1,10 @@
+//go:build aix || solaris
+
+package log
+
+import "golang.org/x/sys/unix"
+
+func isTerminal(fd uintptr) bool {
+	_, err := unix.IoctlGetTermios(int(fd), unix.TCGETA)
+	return err == nil
+}
@@ -0,0 +1,16 @@
+package log
+
+import "golang.org/x/sys/windows"
+
+// isTerminal also turns on the processing of ANSI escape sequences, which
+// older consoles only do on request.
+func isTerminal(fd uintptr) bool {
+	var mode uint32
+	if err := windows.GetConsoleMode(windows.Handle(fd), &mode); err != nil {
+		return false
+	}
+	if mode&windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING == 0 {
+		return windows.SetConsoleMode(windows.Handle(fd), mode|windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING) == nil
+	}
+	return true
+}
@@ -1,8 +1,18 @@
 package notify
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"gopkg.in/gomail.v2"
+	"io"
+	"net"
+	"net/smtp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Email struct {
@@ -13,19 +23,129 @@ type Email struct {
 	Recipient []string `json:"recipient,omitempty"`
 }
 
+// Format tells alert senders that the content is written as an HTML body.
+func (e *Email) Format() string {
+	return FormatHTML
+}
+
 func (e *Email) Send(title string, content string) {
+	if err := e.SendContext(context.Background(), title, content); err != nil {
+		fmt.Println("send email error:", err)
+	}
+}
+
+// SendContext sends the email over a connection whose deadline is the one of
+// ctx, so a slow SMTP server can't keep it running after ctx is done.
+func (e *Email) SendContext(ctx context.Context, title string, content string) error {
 	message := gomail.NewMessage()
 	message.SetHeader("From", message.FormatAddress(e.Username, "异常通知"))
 	message.SetHeader("To", e.Recipient...)
 	message.SetHeader("Subject", title)
 	message.SetBody("text/html", content)
-	dialer := gomail.NewDialer(
-		e.Host,
-		e.Port,
-		e.Username,
-		e.Password,
-	)
-	if err := dialer.DialAndSend(message); err != nil {
-		fmt.Println("send email error:", err)
+
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(e.Host, strconv.Itoa(e.Port)))
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// Cancelling ctx interrupts the SMTP session as well.
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+	tlsConfig := &tls.Config{ServerName: e.Host}
+	if e.Port == 465 {
+		conn = tls.Client(conn, tlsConfig)
+	}
+	client, err := smtp.NewClient(conn, e.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if e.Port != 465 {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+		}
+	}
+	if e.Username != "" {
+		if ok, auths := client.Extension("AUTH"); ok {
+			if err := client.Auth(e.auth(auths)); err != nil {
+				return err
+			}
+		}
+	}
+	err = gomail.Send(gomail.SendFunc(func(from string, to []string, msg io.WriterTo) error {
+		if err := client.Mail(from); err != nil {
+			return err
+		}
+		for _, addr := range to {
+			if err := client.Rcpt(addr); err != nil {
+				return err
+			}
+		}
+		w, err := client.Data()
+		if err != nil {
+			return err
+		}
+		if _, err := msg.WriteTo(w); err != nil {
+			w.Close()
+			return err
+		}
+		return w.Close()
+	}), message)
+	if err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// auth picks the mechanism among those the server offers like gomail.Dialer
+// does: CRAM-MD5 first, LOGIN when PLAIN is missing, PLAIN otherwise.
+func (e *Email) auth(auths string) smtp.Auth {
+	switch {
+	case strings.Contains(auths, "CRAM-MD5"):
+		return smtp.CRAMMD5Auth(e.Username, e.Password)
+	case strings.Contains(auths, "LOGIN") && !strings.Contains(auths, "PLAIN"):
+		return &loginAuth{username: e.Username, password: e.Password, host: e.Host}
+	default:
+		return smtp.PlainAuth("", e.Username, e.Password, e.Host)
+	}
+}
+
+// loginAuth implements the LOGIN mechanism, it is the one of gomail, which
+// does not export it.
+type loginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !slices.Contains(server.Auth, "LOGIN") {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch string(fromServer) {
+	case "Username:":
+		return []byte(a.username), nil
+	case "Password:":
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected server challenge: %s", fromServer)
 	}
 }
@@ -0,0 +1,8 @@
+package notify
+
+// Content formats a notifier accepts, as returned by its Format method.
+const (
+	FormatHTML     = "html"
+	FormatMarkdown = "markdown"
+	FormatText     = "text"
+)
@@ -2,6 +2,8 @@ package notify
 
 import (
 	"fmt"
+	"net/smtp"
+	"strings"
 	"testing"
 )
 
@@ -16,6 +18,35 @@ func TestEmail(t *testing.T) {
 	email.Send("title", "content")
 }
 
+func TestEmailAuth(t *testing.T) {
+	email := Email{Host: "smtp.example.com", Username: "user", Password: "pw"}
+	tests := []struct {
+		auths string
+		want  string
+	}{
+		{"PLAIN LOGIN CRAM-MD5", "CRAM-MD5"},
+		{"LOGIN", "LOGIN"},
+		{"LOGIN PLAIN", "PLAIN"},
+	}
+	for _, tt := range tests {
+		server := &smtp.ServerInfo{Name: email.Host, TLS: true, Auth: strings.Fields(tt.auths)}
+		if proto, _, err := email.auth(tt.auths).Start(server); err != nil || proto != tt.want {
+			t.Errorf("%s: have %s, %v, want %s", tt.auths, proto, err, tt.want)
+		}
+	}
+
+	// LOGIN is used without TLS when the server offers it, as gomail did.
+	login := email.auth("LOGIN")
+	if _, _, err := login.Start(&smtp.ServerInfo{Name: email.Host, Auth: []string{"LOGIN"}}); err != nil {
+		t.Errorf("LOGIN without TLS: %v", err)
+	}
+	for challenge, want := range map[string]string{"Username:": "user", "Password:": "pw"} {
+		if have, err := login.Next([]byte(challenge), true); err != nil || string(have) != want {
+			t.Errorf("%s: have %s, %v", challenge, have, err)
+		}
+	}
+}
+
 func TestWxPusher(t *testing.T) {
 	email := WxPusher{
 		AppToken: "AT_dWk1PSaCmPieZ8MkuY7KqsOHxuwARB3t",
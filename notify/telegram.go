@@ -1,8 +1,13 @@
 package notify
 
 import (
+	"context"
 	"fmt"
 	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"html"
+	"net/http"
+	"strings"
+	"time"
 )
 
 type Telegram struct {
@@ -10,16 +15,43 @@ type Telegram struct {
 	ChatId int64  `json:"chat_id"`
 }
 
+// telegramMaxLength is the limit of a message text in characters.
+const telegramMaxLength = 4096
+
+// Format tells alert senders to pass plain text, Telegram only understands a
+// few HTML tags and the content is escaped before sending.
+func (t *Telegram) Format() string {
+	return FormatText
+}
+
 func (t *Telegram) Send(title string, content string) {
-	bot, err := tgbotapi.NewBotAPI(t.Token)
+	if err := t.SendContext(context.Background(), title, content); err != nil {
+		fmt.Println("send telegram message error", err)
+	}
+}
+
+// SendContext sends the message, the deadline of ctx limits the HTTP requests.
+func (t *Telegram) SendContext(ctx context.Context, title string, content string) error {
+	client := &http.Client{}
+	if deadline, ok := ctx.Deadline(); ok {
+		client.Timeout = time.Until(deadline)
+	}
+	bot, err := tgbotapi.NewBotAPIWithClient(t.Token, tgbotapi.APIEndpoint, client)
 	if err != nil {
-		fmt.Println("new bot error:", err)
-		return
+		return fmt.Errorf("new bot error: %w", err)
+	}
+	text := fmt.Sprintf("<b>%s</b>\n%s", html.EscapeString(title), html.EscapeString(content))
+	if runes := []rune(text); len(runes) > telegramMaxLength {
+		// Cut before a partial entity such as &amp; can break parsing.
+		text = string(runes[:telegramMaxLength-8])
+		if i := strings.LastIndexByte(text, '&'); i > len(text)-8 {
+			text = text[:i]
+		}
+		text += "\n…"
 	}
-	msg := tgbotapi.NewMessage(t.ChatId, fmt.Sprintf("<b>%s</b> (%s)\n", title, content))
+	msg := tgbotapi.NewMessage(t.ChatId, text)
 	msg.ParseMode = "HTML"
 	msg.DisableWebPagePreview = true
-	if _, err = bot.Send(msg); err != nil {
-		fmt.Println("send telegram message error", err)
-	}
+	_, err = bot.Send(msg)
+	return err
 }
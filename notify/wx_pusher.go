@@ -2,42 +2,76 @@ package notify
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 )
 
+// WxPusher content types.
+const (
+	WxPusherText     = 1
+	WxPusherHTML     = 2
+	WxPusherMarkdown = 3
+)
+
 type WxPusher struct {
-	AppToken string   `json:"app_token,omitempty"`
-	TopicIds []int    `json:"topic_ids,omitempty"`
-	Uids     []string `json:"uids,omitempty"`
+	AppToken    string   `json:"app_token,omitempty"`
+	TopicIds    []int    `json:"topic_ids,omitempty"`
+	Uids        []string `json:"uids,omitempty"`
+	ContentType int      `json:"content_type,omitempty"` // 默认为 WxPusherHTML
+}
+
+func (wx *WxPusher) contentType() int {
+	if wx.ContentType == 0 {
+		return WxPusherHTML
+	}
+	return wx.ContentType
+}
+
+func (wx *WxPusher) Format() string {
+	switch wx.contentType() {
+	case WxPusherText:
+		return FormatText
+	case WxPusherMarkdown:
+		return FormatMarkdown
+	default:
+		return FormatHTML
+	}
 }
 
 func (wx *WxPusher) Send(title string, content string) {
+	if err := wx.SendContext(context.Background(), title, content); err != nil {
+		fmt.Println("send wx_pusher error", err)
+	}
+}
+
+func (wx *WxPusher) SendContext(ctx context.Context, title string, content string) error {
 	marshal, err := json.Marshal(map[string]any{
 		"appToken":      wx.AppToken,
 		"summary":       title,
 		"content":       content,
-		"contentType":   2,
+		"contentType":   wx.contentType(),
 		"topicIds":      wx.TopicIds,
 		"uids":          wx.Uids,
 		"verifyPay":     false,
 		"verifyPayType": 0,
 	})
 	if err != nil {
-		fmt.Println("marshal WxPusher message error", err)
-		return
+		return fmt.Errorf("marshal WxPusher message error: %w", err)
 	}
-	req, err := http.NewRequest("POST", "https://wxpusher.zjiecode.com/api/send/message", bytes.NewBuffer(marshal))
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://wxpusher.zjiecode.com/api/send/message", bytes.NewBuffer(marshal))
 	if err != nil {
-		fmt.Println("new request error", err)
-		return
+		return fmt.Errorf("new request error: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		fmt.Println("send wx_pusher error", err)
-		return
+		return err
 	}
 	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("wx_pusher responded with %s", resp.Status)
+	}
+	return nil
 }